@@ -0,0 +1,305 @@
+package rete
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// listFunction and inFunction are the calls rewriteLists turns list literals
+// and the `in` operator into.
+const (
+	listFunction = "__list"
+	inFunction   = "__in"
+)
+
+// internalNames maps the calls rewriteLists introduces back to the syntax
+// they stand for in error messages.
+var internalNames = strings.NewReplacer(inFunction, "in", listFunction, "list")
+
+// restoreNames rewrites the internal names in the message of err.
+func restoreNames(err error) error {
+	msg := err.Error()
+	if restored := internalNames.Replace(msg); restored != msg {
+		return errors.New(restored)
+	}
+	return err
+}
+
+// isIn tells whether exp is the `in` of `x in y`, rewritten to x == __in(y).
+func isIn(exp ast.Expr) bool {
+	b, ok := exp.(*ast.BinaryExpr)
+	return ok && b.Op == token.EQL && isInCall(b.Y)
+}
+
+func isInCall(exp ast.Expr) bool {
+	call, ok := exp.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	fun, ok := call.Fun.(*ast.Ident)
+	return ok && fun.Name == inFunction
+}
+
+func opName(b *ast.BinaryExpr) string {
+	if isIn(b) {
+		return "in"
+	}
+	return b.Op.String()
+}
+
+func isComparison(op token.Token) bool {
+	switch op {
+	case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+		return true
+	}
+	return false
+}
+
+// checkIn rejects `in` where the precedence it gets from the rewrite is not
+// the one it reads with: `a < b in c` would compare a < b to the membership
+// in c, and `a in b + c` would add c to the membership in b. Parentheses
+// make either clear.
+func checkIn(exp ast.Expr) error {
+	var err error
+	ast.Inspect(exp, func(node ast.Node) bool {
+		b, ok := node.(*ast.BinaryExpr)
+		if !ok || err != nil {
+			return err == nil
+		}
+		if isInCall(b.X) || isInCall(b.Y) && !isIn(b) {
+			err = errors.New("OP `in` needs parentheses around its right operand")
+			return false
+		}
+		x, ok := b.X.(*ast.BinaryExpr)
+		if ok && isComparison(b.Op) && isComparison(x.Op) && (isIn(b) || isIn(x)) {
+			err = fmt.Errorf("OP `%s` and `%s` need parentheses", opName(x), opName(b))
+		}
+		return err == nil
+	})
+	return err
+}
+
+// membership is the right operand of `in`, rewritten to `==`.
+type membership struct {
+	collection interface{}
+}
+
+func (m membership) contains(x interface{}) (bool, error) {
+	v := reflect.ValueOf(m.collection)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if eq, err := equalValues(x, v.Index(i).Interface()); err == nil && eq {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		_, err := index(m.collection, x)
+		return err == nil, nil
+	}
+	return false, fmt.Errorf("%s is not a list or map", describeValue(m.collection))
+}
+
+// rewriteLists rewrites `[a, b]` to `__list(a, b)`, and `x in y` to
+// `x == __in(y)`, which Go parses with the precedence `in` should have.
+func rewriteLists(src string) string {
+	type tok struct {
+		offset int
+		tok    token.Token
+		lit    string
+	}
+	var toks []tok
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	s.Init(file, []byte(src), nil, 0)
+	for {
+		pos, t, lit := s.Scan()
+		if t == token.EOF {
+			break
+		}
+		if t == token.SEMICOLON && lit == "\n" {
+			continue
+		}
+		toks = append(toks, tok{file.Offset(pos), t, lit})
+	}
+	// in tells the `in` operators apart from identifiers named in
+	in := make(map[int]bool)
+	endsOperand := func(i int) bool {
+		if i < 0 || in[i] {
+			return false
+		}
+		switch toks[i].tok {
+		case token.IDENT, token.INT, token.FLOAT, token.IMAG, token.CHAR, token.STRING,
+			token.RPAREN, token.RBRACK, token.RBRACE:
+			return true
+		}
+		return false
+	}
+	// closing returns the index of the token closing the bracket at i
+	closing := func(i int) int {
+		depth := 0
+		for j := i; j < len(toks); j++ {
+			switch toks[j].tok {
+			case token.LPAREN, token.LBRACK, token.LBRACE:
+				depth++
+			case token.RPAREN, token.RBRACK, token.RBRACE:
+				depth--
+				if depth == 0 {
+					return j
+				}
+			}
+		}
+		return len(toks) - 1
+	}
+	// endOfPrimary returns the index of the last token of the primary
+	// expression starting at i
+	endOfPrimary := func(i int) int {
+		if i >= len(toks) {
+			return len(toks) - 1
+		}
+		end := i
+		switch toks[i].tok {
+		case token.LPAREN, token.LBRACK, token.LBRACE:
+			end = closing(i)
+		}
+		for end+1 < len(toks) {
+			switch toks[end+1].tok {
+			case token.PERIOD:
+				end += 2
+			case token.LPAREN, token.LBRACK, token.LBRACE:
+				end = closing(end + 1)
+			default:
+				return end
+			}
+		}
+		return end
+	}
+
+	for i, t := range toks {
+		if t.tok == token.IDENT && t.lit == "in" && endsOperand(i-1) && i+1 < len(toks) {
+			in[i] = true
+		}
+	}
+
+	type edit struct {
+		offset, end int
+		text        string
+	}
+	var edits []edit
+	var lists []bool
+	for i, t := range toks {
+		switch {
+		case t.tok == token.LBRACK:
+			isType := i+1 < len(toks) && toks[i+1].tok == token.RBRACK && i+2 < len(toks) &&
+				(toks[i+2].tok == token.IDENT || toks[i+2].tok == token.LBRACK ||
+					toks[i+2].tok == token.MAP || toks[i+2].tok == token.INTERFACE ||
+					toks[i+2].tok == token.MUL)
+			isType = isType || i > 0 && toks[i-1].tok == token.MAP
+			isList := !endsOperand(i-1) && !isType
+			lists = append(lists, isList)
+			if isList {
+				edits = append(edits, edit{t.offset, t.offset + 1, listFunction + "("})
+			}
+		case t.tok == token.RBRACK:
+			if len(lists) > 0 {
+				if lists[len(lists)-1] {
+					edits = append(edits, edit{t.offset, t.offset + 1, ")"})
+				}
+				lists = lists[:len(lists)-1]
+			}
+		case in[i]:
+			edits = append(edits, edit{t.offset, t.offset + len(t.lit), "== " + inFunction + "("})
+			last := toks[endOfPrimary(i+1)]
+			end := last.offset + len(last.lit)
+			if last.lit == "" {
+				end = last.offset + len(last.tok.String())
+			}
+			edits = append(edits, edit{end, end, ")"})
+		}
+	}
+	if len(edits) == 0 {
+		return src
+	}
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].offset < edits[j].offset })
+	var b strings.Builder
+	prev := 0
+	for _, e := range edits {
+		b.WriteString(src[prev:e.offset])
+		b.WriteString(e.text)
+		prev = e.end
+	}
+	b.WriteString(src[prev:])
+	return b.String()
+}
+
+// member returns a key of a map or a field of a struct.
+func member(v interface{}, name string) (interface{}, error) {
+	rv := indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			r := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+			if !r.IsValid() {
+				return nil, fmt.Errorf("key `%s` missing", name)
+			}
+			return r.Interface(), nil
+		}
+	case reflect.Struct:
+		field, ok := rv.Type().FieldByName(name)
+		if ok && field.IsExported() {
+			return rv.FieldByIndex(field.Index).Interface(), nil
+		}
+		return nil, fmt.Errorf("field `%s` missing in %s", name, rv.Type())
+	}
+	return nil, fmt.Errorf("%s has no member `%s`", describeValue(v), name)
+}
+
+// index returns an element of a list or the value of a key of a map.
+func index(v interface{}, k interface{}) (interface{}, error) {
+	rv := indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		f, ok := asFloat(k)
+		if !ok || f != math.Trunc(f) {
+			return nil, fmt.Errorf("index %s not an integer", describeValue(k))
+		}
+		if f < 0 || f >= float64(rv.Len()) {
+			return nil, fmt.Errorf("index %v out of range [0:%d)", f, rv.Len())
+		}
+		return rv.Index(int(f)).Interface(), nil
+	case reflect.Map:
+		key := reflect.ValueOf(k)
+		keyType := rv.Type().Key()
+		if keyType.Kind() == reflect.String {
+			key = reflect.ValueOf(bindingString(k))
+		}
+		if !key.IsValid() || !key.Type().ConvertibleTo(keyType) {
+			return nil, fmt.Errorf("key %s not a %s", describeValue(k), keyType)
+		}
+		r := rv.MapIndex(key.Convert(keyType))
+		if !r.IsValid() {
+			return nil, fmt.Errorf("key %s missing", describeValue(k))
+		}
+		return r.Interface(), nil
+	}
+	return nil, fmt.Errorf("%s cannot be indexed", describeValue(v))
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v
+		}
+		v = v.Elem()
+	}
+	return v
+}
@@ -0,0 +1,121 @@
+package rete
+
+import (
+	"container/list"
+)
+
+type AccumulateNode struct {
+	parent   IReteNode
+	children *list.List
+	items    *list.List
+	amem     *AlphaMemory
+	tests    *list.List
+	acc      *Accumulate
+	options  *evalOptions
+}
+
+func (node AccumulateNode) GetNodeType() string {
+	return AccumulateNodeTy
+}
+func (node AccumulateNode) GetParent() IReteNode {
+	return node.parent
+}
+func (node AccumulateNode) GetItems() *list.List {
+	return node.items
+}
+func (node *AccumulateNode) GetChildren() *list.List {
+	return node.children
+}
+func (node *AccumulateNode) LeftActivation(t *Token, w *WME, b Env) {
+	newToken := makeToken(node, t, w, b)
+	node.items.PushBack(newToken)
+
+	newToken.joinResults = list.New()
+	newToken.accumulator = node.acc.reducer()
+	for e := node.amem.items.Front(); e != nil; e = e.Next() {
+		w := e.Value.(*WME)
+		if node.performJoinTests(newToken, w) {
+			jr := &NegativeJoinResult{
+				owner: newToken,
+				wme:   w,
+			}
+			newToken.joinResults.PushBack(jr)
+			w.negativeJoinResults.PushBack(jr)
+			node.add(newToken, w)
+		}
+	}
+	node.propagate(newToken)
+}
+func (node *AccumulateNode) RightActivation(w *WME) {
+	for e := node.items.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*Token)
+		if !node.performJoinTests(t, w) {
+			continue
+		}
+		jr := &NegativeJoinResult{
+			owner: t,
+			wme:   w,
+		}
+		t.joinResults.PushBack(jr)
+		w.negativeJoinResults.PushBack(jr)
+		node.add(t, w)
+		t.deleteDescendents()
+		node.propagate(t)
+	}
+}
+
+// retract removes a WME from the aggregate of t and replaces the matches
+// below t with ones carrying the new result.
+func (node *AccumulateNode) retract(t *Token, w *WME) {
+	if acc, ok := t.accumulator.(wmeAccumulator); ok {
+		acc.removeWME(w)
+	} else {
+		t.accumulator.Remove(node.valueOf(w))
+	}
+	t.deleteDescendents()
+	node.propagate(t)
+}
+
+func (node *AccumulateNode) add(t *Token, w *WME) {
+	if acc, ok := t.accumulator.(wmeAccumulator); ok {
+		acc.addWME(w)
+	} else {
+		t.accumulator.Add(node.valueOf(w))
+	}
+}
+
+// binding returns the result bound for the children of t, or false when the
+// accumulator has no result. In decimal mode, accumulators with an exact
+// result bind it instead.
+func (node *AccumulateNode) binding(t *Token) (Env, bool) {
+	var r interface{}
+	acc, ok := t.accumulator.(decimalAccumulator)
+	if ok && node.options != nil && node.options.decimal != nil {
+		r = acc.decimalResult(node.options.decimal)
+	} else {
+		r = t.accumulator.Result()
+	}
+	if r == nil {
+		return nil, false
+	}
+	return Env{varKey(node.acc.result): r}, true
+}
+func (node *AccumulateNode) propagate(t *Token) {
+	b, ok := node.binding(t)
+	if !ok {
+		return
+	}
+	for e := node.children.Front(); e != nil; e = e.Next() {
+		child := e.Value.(IReteNode)
+		child.LeftActivation(t, nil, b)
+	}
+}
+func (node *AccumulateNode) valueOf(w *WME) string {
+	if idx := node.acc.contain(node.acc.of); idx != -1 {
+		return w.fields[idx]
+	}
+	return ""
+}
+func (node *AccumulateNode) performJoinTests(t *Token, w *WME) bool {
+	return performJoinTests(node.tests, t, w)
+}
@@ -0,0 +1,85 @@
+package rete
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ActionHandler is the Go code a production runs when it fires.
+type ActionHandler func(ctx context.Context, network *Network, token *Token) error
+
+// ActionRegistry maps the tmpl of a production's RHS to its handler.
+type ActionRegistry struct {
+	lock     sync.RWMutex
+	handlers map[string]ActionHandler
+}
+
+func NewActionRegistry() *ActionRegistry {
+	return &ActionRegistry{handlers: make(map[string]ActionHandler)}
+}
+
+// Register adds the handler of name. A name is registered once.
+func (r *ActionRegistry) Register(name string, handler ActionHandler) error {
+	if name == "" || handler == nil {
+		return errors.New("handler needs a name and a function")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.handlers[name] != nil {
+		return fmt.Errorf("handler `%s` already registered", name)
+	}
+	r.handlers[name] = handler
+	return nil
+}
+
+// Lookup returns the handler of name.
+func (r *ActionRegistry) Lookup(name string) (ActionHandler, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	h, ok := r.handlers[name]
+	return h, ok
+}
+
+// Names returns the registered names, sorted.
+func (r *ActionRegistry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var ret []string
+	for name := range r.handlers {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// SetActionRegistry makes ExecuteRules run handlers from r, before looking in
+// its Env, and makes loading a production whose tmpl r does not know fail.
+// It fails, keeping the current registry, if a production already in the
+// network has no handler in r. A nil r removes the registry.
+func (n *Network) SetActionRegistry(r *ActionRegistry) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if r != nil {
+		for _, pNode := range n.PNodes {
+			if err := r.check(pNode.RHS); err != nil {
+				return err
+			}
+		}
+	}
+	n.registry = r
+	return nil
+}
+
+// check reports an rhs whose handler is not registered.
+func (r *ActionRegistry) check(rhs *RHS) error {
+	if r == nil || rhs == nil || rhs.tmpl == "" {
+		return nil
+	}
+	if _, ok := r.Lookup(rhs.tmpl); !ok {
+		return fmt.Errorf("handler `%s` not registered", rhs.tmpl)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package rete
+
+import (
+	"errors"
+	"fmt"
+)
+
+type actionKind int
+
+const (
+	retractAction actionKind = iota
+	modifyAction
+	assertAction
+)
+
+// action is a change to working memory declared in the rhs of a production.
+// Fields that are variables take their value from the LHS; a modify leaves
+// the fields that are "" as they are, and skips a WME that is no longer in
+// working memory, such as one the retracts of the same rhs removed.
+type action struct {
+	kind actionKind
+	// wme is the `as` variable of a has condition, naming the WME it matched
+	wme    string
+	fields [4]string
+	// logical asserts the WME for as long as the token matches
+	logical bool
+}
+
+// factFields are the JSON names of the fields of a WME.
+var factFields = [4]string{"classname", "identifier", "attribute", "value"}
+
+// parseActions reads the retract, modify and assert entries of a JSON rhs,
+// which run in that order. Each is an object or a list of them; a retract
+// may also name the WME of a has condition by its `as` variable:
+//
+//	{"retract": "$w"}
+//	{"modify": {"wme": "$w", "value": "$total"}}
+//	{"assert": [{"classname": "Order", "identifier": "$id", "attribute": "state", "value": "paid"}]}
+//
+// An assert with "logical": true is retracted once the match goes away, see
+// AssertLogical.
+func parseActions(rhs map[string]interface{}) ([]action, error) {
+	var ret []action
+	for _, e := range asList(rhs["retract"]) {
+		if v, ok := e.(string); ok {
+			if !isVar(v) {
+				return nil, fmt.Errorf("retract `%s` not a variable", v)
+			}
+			ret = append(ret, action{kind: retractAction, wme: v})
+			continue
+		}
+		fields, err := parseFact("retract", e, false)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, action{kind: retractAction, fields: fields})
+	}
+	for _, e := range asList(rhs["modify"]) {
+		fields, err := parseFact("modify", e, true)
+		if err != nil {
+			return nil, err
+		}
+		w, ok := e.(map[string]interface{})["wme"].(string)
+		if !ok || !isVar(w) {
+			return nil, fmt.Errorf("modify wme not a variable: %v", e)
+		}
+		ret = append(ret, action{kind: modifyAction, wme: w, fields: fields})
+	}
+	for _, e := range asList(rhs["assert"]) {
+		fields, err := parseFact("assert", e, false)
+		if err != nil {
+			return nil, err
+		}
+		logical, ok := e.(map[string]interface{})["logical"].(bool)
+		if !ok && e.(map[string]interface{})["logical"] != nil {
+			return nil, fmt.Errorf("assert logical not a bool: %v", e)
+		}
+		ret = append(ret, action{kind: assertAction, fields: fields, logical: logical})
+	}
+	return ret, nil
+}
+
+func asList(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	}
+	return []interface{}{v}
+}
+
+// parseFact reads the fields of a WME. With partial, fields may be missing.
+func parseFact(kind string, e interface{}, partial bool) ([4]string, error) {
+	var fields [4]string
+	obj, ok := e.(map[string]interface{})
+	if !ok {
+		return fields, fmt.Errorf("%s not Object: %v", kind, e)
+	}
+	for i, name := range factFields {
+		v, ok := obj[name].(string)
+		if !ok && (!partial || obj[name] != nil) {
+			return fields, fmt.Errorf("%s missing fields: %v", kind, e)
+		}
+		fields[i] = v
+	}
+	return fields, nil
+}
+
+// parseWMEVars reads the `as` variables of the top-level has conditions and
+// maps them to the token level of their condition.
+func parseWMEVars(raw []interface{}, lhs LHS) (map[string]int, error) {
+	wmes := make(map[string]int)
+	level := 0
+	for i, item := range lhs.items {
+		as, ok := raw[i].(map[string]interface{})["as"]
+		if ok {
+			v, ok := as.(string)
+			if has, isHas := item.(Has); !ok || !isVar(v) || !isHas || has.negative {
+				return nil, fmt.Errorf("as `%v` must name a has condition with a variable", as)
+			}
+			wmes[varKey(v)] = level
+		}
+		if addsToken(item) {
+			level++
+		}
+	}
+	return wmes, nil
+}
+
+// validateActions checks that actions only use variables the LHS binds.
+func validateActions(lhs LHS, rhs RHS) error {
+	bound := make(map[string]bool)
+	if err := validateItems(lhs.items, bound, nil); err != nil {
+		return err
+	}
+	for _, a := range rhs.actions {
+		if a.wme != "" {
+			if _, ok := rhs.wmes[varKey(a.wme)]; !ok {
+				return fmt.Errorf("rhs `%s` names no has condition", a.wme)
+			}
+		}
+		for _, f := range a.fields {
+			if isVar(f) && !bound[varKey(f)] {
+				return fmt.Errorf("rhs variable `%s` unbound", f)
+			}
+		}
+	}
+	return nil
+}
+
+// fireActions runs the actions of rhs for t, holding the network lock.
+func (n *Network) fireActions(rhs *RHS, t *Token) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	defer n.settle()
+	wmes := t.get_wmes()
+	for _, a := range rhs.actions {
+		fields, err := a.resolve(t)
+		if err != nil {
+			return err
+		}
+		var w *WME
+		if a.wme != "" {
+			w = wmes[rhs.wmes[varKey(a.wme)]]
+		}
+		switch a.kind {
+		case retractAction:
+			if w != nil {
+				n.retract(w)
+				continue
+			}
+			for _, w := range n.workingMemory() {
+				if w.fields == fields {
+					n.retract(w)
+				}
+			}
+		case modifyAction:
+			if contain(n.alphaRoot.outputMemory.items, w) == nil {
+				continue
+			}
+			modified := w.fields
+			for i, f := range fields {
+				if f != "" {
+					modified[i] = f
+				}
+			}
+			if modified != w.fields {
+				n.retract(w)
+				n.assert(modified)
+			}
+		case assertAction:
+			if !a.logical {
+				n.assert(fields)
+			} else if err := n.assertLogical(t, fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a action) resolve(t *Token) ([4]string, error) {
+	fields := a.fields
+	for i, f := range fields {
+		if !isVar(f) {
+			continue
+		}
+		v := t.GetBinding(varKey(f))
+		if v == nil {
+			return fields, errors.New("variable `" + f + "` unbound")
+		}
+		fields[i] = bindingString(v)
+	}
+	return fields, nil
+}
+
+func (n *Network) workingMemory() []*WME {
+	var ret []*WME
+	for e := n.alphaRoot.outputMemory.items.Front(); e != nil; e = e.Next() {
+		ret = append(ret, e.Value.(*WME))
+	}
+	return ret
+}
+
+// retract removes w if it is still in working memory.
+func (n *Network) retract(w *WME) {
+	if contain(n.alphaRoot.outputMemory.items, w) != nil {
+		n.tms.forget(w)
+		n.wmeRetracted(w)
+		RemoveWME(w)
+	}
+}
+
+// assert adds a WME unless an equal one is in working memory, so that
+// rules asserting what they match do not fire again and again.
+func (n *Network) assert(fields [4]string) {
+	for _, w := range n.workingMemory() {
+		if w.fields == fields {
+			return
+		}
+	}
+	w := NewWME(fields[0], fields[1], fields[2], fields[3])
+	n.wmeAsserted(w)
+	n.alphaRoot.activation(w)
+}
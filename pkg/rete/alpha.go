@@ -37,3 +37,20 @@ func (node *AlphaMemory) activation(w *WME) {
 		e.Value.(IReteNode).RightActivation(w)
 	}
 }
+
+// prune detaches amem from the subtree rooted at node and drops the constant
+// test nodes left without an output memory or children. It reports whether
+// node itself is unused.
+func (node *ConstantTestNode) prune(amem *AlphaMemory) bool {
+	if node.outputMemory == amem {
+		node.outputMemory = nil
+	}
+	for e := node.children.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*ConstantTestNode).prune(amem) {
+			node.children.Remove(e)
+		}
+		e = next
+	}
+	return node.outputMemory == nil && node.children.Len() == 0
+}
@@ -183,10 +183,12 @@ func TestChainActivationThroughConstantTestNodeSimplified(t *testing.T) {
 
 	// Similar initialization for childNode with proper AlphaMemory setup
 	childNode := ConstantTestNode{
+		fieldToTest: NoTest, // Accept every WME the root node passes on
 		outputMemory: &AlphaMemory{
 			items:      list.New(), // Ensure items list is initialized
 			successors: list.New(), // Ensure successors list is initialized
 		},
+		children: list.New(),
 	}
 
 	for e := rootNode.children.Front(); e != nil; e = e.Next() {
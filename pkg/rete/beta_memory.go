@@ -9,6 +9,8 @@ type BetaMemory struct {
 	parent   IReteNode
 	children *list.List
 	RHS      *RHS
+	// listeners is set on P-nodes
+	listeners *listeners
 }
 
 func (node BetaMemory) GetNodeType() string {
@@ -30,6 +32,9 @@ func (node BetaMemory) GetChildren() *list.List {
 func (node *BetaMemory) LeftActivation(t *Token, w *WME, b Env) {
 	newToken := makeToken(node, t, w, b)
 	node.items.PushBack(newToken)
+	for _, l := range node.listeners.get() {
+		l.ActivationCreated(node, newToken)
+	}
 	for e := node.children.Front(); e != nil; e = e.Next() {
 		e.Value.(IReteNode).LeftActivation(newToken, nil, nil)
 	}
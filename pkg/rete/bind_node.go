@@ -0,0 +1,58 @@
+package rete
+
+import (
+	"container/list"
+)
+
+// BindNode extends the bindings it passes down with the value of an
+// expression. Like a filter it adds no token, so the value ends up in the
+// binding of the token its children create.
+type BindNode struct {
+	parent   IReteNode
+	children *list.List
+	variable string
+	tmpl     string
+	expr     *Expression
+	errors   *filterErrors
+	options  *evalOptions
+}
+
+func (node BindNode) GetNodeType() string {
+	return BindNodeTy
+}
+func (node BindNode) GetItems() *list.List {
+	return nil
+}
+func (node BindNode) GetParent() IReteNode {
+	return node.parent
+}
+func (node BindNode) GetChildren() *list.List {
+	return node.children
+}
+func (node *BindNode) RightActivation(w *WME) {
+}
+
+// LeftActivation drops the token if the expression fails. The error is
+// reported like a filter error, but drops the token whatever the policy.
+func (node *BindNode) LeftActivation(t *Token, w *WME, b Env) {
+	all_binding := t.AllBinding()
+	for k, v := range b {
+		all_binding[k] = v
+	}
+	result, err := node.expr.evalWith(all_binding, node.options)
+	if err != nil {
+		if node.errors != nil {
+			node.errors.report(node.tmpl, all_binding, err)
+		}
+		return
+	}
+	binding := make(Env, len(b)+1)
+	for k, v := range b {
+		binding[k] = v
+	}
+	binding[varKey(node.variable)] = result
+	for e := node.children.Front(); e != nil; e = e.Next() {
+		child := e.Value.(IReteNode)
+		child.LeftActivation(t, w, binding)
+	}
+}
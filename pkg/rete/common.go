@@ -1,5 +1,13 @@
 package rete
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
 func isVar(v string) bool {
 	return len(v) > 0 && v[0] == '$'
 }
@@ -11,11 +19,71 @@ func varKey(v string) string {
 	return ""
 }
 
+// bindingString formats a bound value the way it would appear in a WME field,
+// so that computed values can be joined against WMEs.
+func bindingString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
 type Production struct {
 	lhs LHS
 	rhs RHS
 }
 
+func NewProduction(lhs LHS, rhs RHS) Production {
+	return Production{
+		lhs: lhs,
+		rhs: rhs,
+	}
+}
+
+// key identifies a production by its content, so that reloading an unchanged
+// production can keep the one already in the network.
+func (p Production) key() string {
+	return fmt.Sprintf("%s => %s %v %v %q", describe(p.lhs), p.rhs.tmpl, p.rhs.Extra, p.rhs.wmes, p.rhs.templateText)
+}
+
+// describe renders a condition, or a whole LHS, in a canonical form.
+func describe(cond interface{}) string {
+	switch cond := cond.(type) {
+	case Has:
+		if cond.negative {
+			return fmt.Sprintf("neg%s", cond.fields)
+		}
+		return fmt.Sprintf("has%s", cond.fields)
+	case Exists:
+		return fmt.Sprintf("exists%s", cond.fields)
+	case Accumulate:
+		return fmt.Sprintf("accumulate%s(%s %p)->%s", cond.fields, cond.of, cond.reducer, cond.result)
+	case Collect:
+		return fmt.Sprintf("collect%s(%s)->%s", cond.fields, cond.of, cond.result)
+	case Filter:
+		return fmt.Sprintf("filter(%s)", cond.tmpl)
+	case Bind:
+		return fmt.Sprintf("bind(%s = %s)", cond.variable, cond.tmpl)
+	case Forall:
+		return fmt.Sprintf("forall{%s}", describe(NewLHS(append([]interface{}{cond.cond}, cond.requirements...)...)))
+	case LHS:
+		var ret []string
+		for _, item := range cond.items {
+			ret = append(ret, describe(item))
+		}
+		if cond.negative {
+			return fmt.Sprintf("ncc{%s}", strings.Join(ret, " "))
+		}
+		return strings.Join(ret, " ")
+	}
+	return fmt.Sprint(cond)
+}
+
 type LHS struct {
 	items    []interface{}
 	negative bool
@@ -24,6 +92,13 @@ type LHS struct {
 type RHS struct {
 	tmpl  string
 	Extra map[string]interface{}
+	// actions declared in JSON, and the token level of the WME each `as`
+	// variable names
+	actions []action
+	wmes    map[string]int
+	// template renders the output of a firing, see SetTemplate
+	template     *template.Template
+	templateText string
 }
 
 type Has struct {
@@ -31,10 +106,61 @@ type Has struct {
 	negative bool
 }
 
+// Exists matches once per parent match while at least one WME satisfies the
+// pattern. Like a negation, its variables are not bound for later conditions.
+type Exists struct {
+	Has
+}
+
+// Forall matches when every match of cond also satisfies all requirements.
+// It is compiled to the negated conjunction not(cond and not(requirements)).
+type Forall struct {
+	cond         interface{}
+	requirements []interface{}
+}
+
+// Accumulate folds the WMEs matching the pattern for each parent match into a
+// single value bound to result. of names the pattern variable being reduced.
+type Accumulate struct {
+	Has
+	of      string
+	reducer Reducer
+	result  string
+}
+
+// Collect binds result to the list of WMEs matching the pattern for each
+// parent match, or to the list of values of the variable of when it is set.
+type Collect struct {
+	Has
+	of     string
+	result string
+}
+
 type Filter struct {
 	tmpl string
 }
 
+// Bind binds a variable to the value of an expression over earlier bindings,
+// so later conditions can join or filter on it.
+type Bind struct {
+	variable string
+	tmpl     string
+}
+
+func NewBind(variable string, tmpl string) Bind {
+	return Bind{variable: variable, tmpl: tmpl}
+}
+
+// addsToken reports whether a condition adds a level to the token chain.
+// Filters and binds pass tokens through.
+func addsToken(cond interface{}) bool {
+	switch cond.(type) {
+	case Filter, Bind:
+		return false
+	}
+	return true
+}
+
 func (has Has) contain(s string) int {
 	for idx, v := range has.fields {
 		if v == s {
@@ -70,6 +196,57 @@ func NewNeg(className, id, attr, value string) Has {
 	}
 }
 
+func NewExists(className, id, attr, value string) Exists {
+	return Exists{
+		Has: NewHas(className, id, attr, value),
+	}
+}
+
+func NewAccumulate(pattern Has, of string, reducer Reducer, result string) Accumulate {
+	return Accumulate{
+		Has:     pattern,
+		of:      of,
+		reducer: reducer,
+		result:  result,
+	}
+}
+
+func NewCollect(pattern Has, of string, result string) Collect {
+	return Collect{
+		Has:    pattern,
+		of:     of,
+		result: result,
+	}
+}
+
+// accumulate returns the accumulate condition the collect is built from.
+func (collect Collect) accumulate() Accumulate {
+	field := collect.contain(collect.of)
+	reducer := func() Accumulator {
+		return &collectAccumulator{field: field}
+	}
+	return NewAccumulate(collect.Has, collect.of, reducer, collect.result)
+}
+
+func NewForall(cond interface{}, requirements ...interface{}) Forall {
+	return Forall{
+		cond:         cond,
+		requirements: requirements,
+	}
+}
+
+// ncc returns the negated conjunction the forall is built from. A single
+// positive requirement is negated with a negative node instead of a nested NCC.
+func (forall Forall) ncc() LHS {
+	if len(forall.requirements) == 1 {
+		if has, ok := forall.requirements[0].(Has); ok && !has.negative {
+			has.negative = true
+			return NewNccRule(forall.cond, has)
+		}
+	}
+	return NewNccRule(forall.cond, NewNccRule(forall.requirements...))
+}
+
 func NewLHS(items ...interface{}) LHS {
 	return LHS{
 		items: items,
@@ -12,9 +12,12 @@ const (
 	BetaMemoryNodeTy = "beta_memory"
 	JoinNodeTy       = "join_node"
 	NegativeNodeTy   = "negative_node"
+	ExistsNodeTy     = "exists_node"
+	AccumulateNodeTy = "accumulate_node"
 	NccNodeTy        = "ncc_node"
 	NccPartnerNodeTy = "ncc_parter_node"
 	FilterNodeTy     = "filter_node"
+	BindNodeTy       = "bind_node"
 )
 
 var FIELDS = []int{ClassName, Identifier, Attribute, Value}
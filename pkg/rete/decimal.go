@@ -0,0 +1,201 @@
+package rete
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// RoundingMode decides how a quotient is rounded to the scale of a
+// DecimalMode.
+type RoundingMode int
+
+const (
+	// RoundHalfEven rounds to the nearest, ties to the even neighbour.
+	RoundHalfEven RoundingMode = iota
+	// RoundHalfUp rounds to the nearest, ties away from zero.
+	RoundHalfUp
+	// RoundDown rounds toward zero.
+	RoundDown
+	// RoundUp rounds away from zero.
+	RoundUp
+)
+
+// DecimalMode makes expressions compute with exact decimals instead of
+// float64. Numbers in expressions and WME values become Decimals; sums,
+// differences and products are exact, and quotients are rounded to Scale
+// digits after the decimal point. The sums and averages of accumulate
+// conditions are Decimals too.
+type DecimalMode struct {
+	Scale    int
+	Rounding RoundingMode
+}
+
+// Decimal is an exact decimal number, the number type of expressions in
+// decimal mode.
+type Decimal struct {
+	rat *big.Rat
+}
+
+// NewDecimal parses a decimal such as "12.50".
+func NewDecimal(s string) (Decimal, error) {
+	r, ok := asRat(s)
+	if !ok {
+		return Decimal{}, fmt.Errorf("%s is not a decimal", strconv.Quote(s))
+	}
+	return Decimal{r}, nil
+}
+
+// value is the number of d. The zero Decimal is 0.
+func (d Decimal) value() *big.Rat {
+	if d.rat == nil {
+		return new(big.Rat)
+	}
+	return d.rat
+}
+
+// String formats the decimal with as many digits as it has.
+func (d Decimal) String() string {
+	r := d.value()
+	den := new(big.Int).Set(r.Denom())
+	twos, fives := 0, 0
+	for den.Bit(0) == 0 {
+		den.Rsh(den, 1)
+		twos++
+	}
+	five, rem := big.NewInt(5), new(big.Int)
+	for {
+		q, r := new(big.Int).QuoRem(den, five, rem)
+		if r.Sign() != 0 {
+			break
+		}
+		den = q
+		fives++
+	}
+	if den.Cmp(big.NewInt(1)) != 0 {
+		// not a terminating decimal
+		return r.FloatString(16)
+	}
+	return r.FloatString(max(twos, fives))
+}
+
+func (d Decimal) Float64() float64 {
+	f, _ := d.value().Float64()
+	return f
+}
+
+// Rat returns a copy of the value.
+func (d Decimal) Rat() *big.Rat {
+	return new(big.Rat).Set(d.value())
+}
+
+// asRat converts numbers and strings that parse as one.
+func asRat(v interface{}) (*big.Rat, bool) {
+	switch v := v.(type) {
+	case Decimal:
+		return v.value(), true
+	case string:
+		// big.Rat also reads fractions and hexadecimals, which are not
+		// numbers elsewhere
+		if !isDecimalLiteral(v) {
+			return nil, false
+		}
+		return new(big.Rat).SetString(v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, false
+		}
+		return new(big.Rat).SetString(strconv.FormatFloat(v, 'f', -1, 64))
+	case int:
+		return new(big.Rat).SetInt64(int64(v)), true
+	}
+	return nil, false
+}
+
+// decimalOperands converts both operands in decimal mode.
+func decimalOperands(c *evalContext, l, r interface{}) (*big.Rat, *big.Rat, bool) {
+	if c.decimal == nil {
+		return nil, nil, false
+	}
+	a, ok := asRat(l)
+	if !ok {
+		return nil, nil, false
+	}
+	b, ok := asRat(r)
+	if !ok {
+		return nil, nil, false
+	}
+	return a, b, true
+}
+
+func decimalArithmetic(mode *DecimalMode, op token.Token, a, b *big.Rat) (interface{}, error) {
+	r := new(big.Rat)
+	switch op {
+	case token.ADD:
+		r.Add(a, b)
+	case token.SUB:
+		r.Sub(a, b)
+	case token.MUL:
+		r.Mul(a, b)
+	case token.QUO, token.REM:
+		if b.Sign() == 0 {
+			return nil, errors.New("division by zero")
+		}
+		r.Quo(a, b)
+		if op == token.QUO {
+			r = mode.round(r)
+			break
+		}
+		// the remainder of truncated division, like math.Mod
+		q := new(big.Int).Quo(r.Num(), r.Denom())
+		r.Sub(a, new(big.Rat).Mul(b, new(big.Rat).SetInt(q)))
+	default:
+		return nil, fmt.Errorf("OP `%s` undefined", op)
+	}
+	return Decimal{r}, nil
+}
+
+// decimalArgs converts the arguments of a numeric function when one of them
+// is a Decimal, so that the function can compute exactly.
+func decimalArgs(args []interface{}) ([]*big.Rat, bool, error) {
+	isDecimal := false
+	for _, arg := range args {
+		if _, ok := arg.(Decimal); ok {
+			isDecimal = true
+		}
+	}
+	if !isDecimal {
+		return nil, false, nil
+	}
+	ret := make([]*big.Rat, len(args))
+	for i, arg := range args {
+		r, ok := asRat(arg)
+		if !ok {
+			return nil, true, fmt.Errorf("%s is not a number", describeValue(arg))
+		}
+		ret[i] = r
+	}
+	return ret, true, nil
+}
+
+// round rounds r to the scale of the mode.
+func (mode *DecimalMode) round(r *big.Rat) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(mode.Scale)), nil)
+	x := new(big.Rat).Mul(r, new(big.Rat).SetInt(scale))
+	num, den := x.Num(), x.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() != 0 {
+		away := mode.Rounding == RoundUp
+		if mode.Rounding == RoundHalfEven || mode.Rounding == RoundHalfUp {
+			c := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(den)
+			away = c > 0 || c == 0 && (mode.Rounding == RoundHalfUp || q.Bit(0) == 1)
+		}
+		if away {
+			q.Add(q, big.NewInt(int64(num.Sign())))
+		}
+	}
+	return new(big.Rat).SetFrac(q, scale)
+}
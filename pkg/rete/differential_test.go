@@ -0,0 +1,493 @@
+package rete
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var (
+	fuzzIds    = []string{"B1", "B2", "B3"}
+	fuzzAttrs  = []string{"on", "left_of", "color"}
+	fuzzValues = []string{"B1", "B2", "B3", "1", "2", "red"}
+	fuzzVars   = []string{"$x", "$y", "$z", "$w"}
+	fuzzTests  = []string{"%s > 1", "%s <= 2", "%s == %s", "%s + %s >= 3", "%s != %s"}
+	fuzzReduce = []string{"count", "sum", "min", "max", "avg", "collect"}
+	fuzzBinds  = []string{"%s + 1", "%s * %s", "len(%s)"}
+)
+
+// choices turns fuzzer input into generator decisions. Once the input is
+// exhausted every decision falls back to the first option.
+type choices struct {
+	data []byte
+	pos  int
+}
+
+func (c *choices) intn(n int) int {
+	if n <= 1 || c.pos >= len(c.data) {
+		return 0
+	}
+	b := c.data[c.pos]
+	c.pos++
+	return int(b) % n
+}
+
+func (c *choices) pick(s []string) string {
+	return s[c.intn(len(s))]
+}
+
+type fuzzGen struct {
+	c *choices
+}
+
+func (g *fuzzGen) wme() *WME {
+	return NewWME("Object", g.c.pick(fuzzIds), g.c.pick(fuzzAttrs), g.c.pick(fuzzValues))
+}
+
+// has draws a condition whose identifier and value are either constants or
+// variables. A variable is never repeated inside one condition since join
+// tests only compare against earlier conditions.
+func (g *fuzzGen) has(bound map[string]bool, negative bool) Has {
+	fields := [4]string{"Object", g.c.pick(fuzzIds), g.c.pick(fuzzAttrs), g.c.pick(fuzzValues)}
+	used := make(map[string]bool)
+	for _, field := range []int{Identifier, Value} {
+		if g.c.intn(2) == 0 {
+			continue
+		}
+		v := g.c.pick(fuzzVars)
+		if !used[v] {
+			used[v] = true
+			fields[field] = v
+		}
+	}
+	if negative {
+		return NewNeg(fields[0], fields[1], fields[2], fields[3])
+	}
+	for v := range used {
+		bound[v] = true
+	}
+	return NewHas(fields[0], fields[1], fields[2], fields[3])
+}
+
+// filter draws an expression over variables already bound, or returns false
+// when nothing is bound yet.
+func (g *fuzzGen) filter(bound map[string]bool) (Filter, bool) {
+	var vars []string
+	for v := range bound {
+		vars = append(vars, varKey(v))
+	}
+	if len(vars) == 0 {
+		return Filter{}, false
+	}
+	sort.Strings(vars)
+	tmpl := g.c.pick(fuzzTests)
+	if strings.Count(tmpl, "%s") == 1 {
+		return Filter{tmpl: fmt.Sprintf(tmpl, g.c.pick(vars))}, true
+	}
+	return Filter{tmpl: fmt.Sprintf(tmpl, g.c.pick(vars), g.c.pick(vars))}, true
+}
+
+// bind draws an expression over variables already bound, bound to a variable
+// not bound yet, or returns false when that is not possible.
+func (g *fuzzGen) bind(bound map[string]bool) (Bind, bool) {
+	var vars, free []string
+	for _, v := range fuzzVars {
+		if bound[v] {
+			vars = append(vars, varKey(v))
+		} else {
+			free = append(free, v)
+		}
+	}
+	if len(vars) == 0 || len(free) == 0 {
+		return Bind{}, false
+	}
+	tmpl := g.c.pick(fuzzBinds)
+	if strings.Count(tmpl, "%s") == 1 {
+		tmpl = fmt.Sprintf(tmpl, g.c.pick(vars))
+	} else {
+		tmpl = fmt.Sprintf(tmpl, g.c.pick(vars), g.c.pick(vars))
+	}
+	result := g.c.pick(free)
+	bound[result] = true
+	return NewBind(result, tmpl), true
+}
+
+// accumulate draws a reduction or a collect over a fresh pattern whose result
+// is bound to a variable not bound yet, or returns false when every variable
+// is taken.
+func (g *fuzzGen) accumulate(bound map[string]bool) (interface{}, bool) {
+	var free []string
+	for _, v := range fuzzVars {
+		if !bound[v] {
+			free = append(free, v)
+		}
+	}
+	if len(free) == 0 {
+		return nil, false
+	}
+	pattern := g.has(make(map[string]bool), false)
+	result := g.c.pick(free)
+	bound[result] = true
+	name := g.c.pick(fuzzReduce)
+	if name == "collect" {
+		return NewCollect(pattern, pattern.fields[Value], result), true
+	}
+	reducer, _ := GetReducer(name)
+	return NewAccumulate(pattern, pattern.fields[Value], reducer, result), true
+}
+
+// items draws up to max conditions. Bindings made inside a negated
+// conjunction or a forall are not visible after it.
+func (g *fuzzGen) items(bound map[string]bool, max int, depth int) []interface{} {
+	var ret []interface{}
+	kinds := 6
+	if depth < 2 {
+		kinds = 8
+	}
+	for i := g.c.intn(max); i > 0; i-- {
+		switch g.c.intn(kinds) {
+		case 0:
+			ret = append(ret, g.has(bound, false))
+		case 1:
+			ret = append(ret, g.has(bound, true))
+		case 2:
+			if f, ok := g.filter(bound); ok {
+				ret = append(ret, f)
+			}
+		case 3:
+			ret = append(ret, Exists{Has: g.has(make(map[string]bool), false)})
+		case 4:
+			if acc, ok := g.accumulate(bound); ok {
+				ret = append(ret, acc)
+			}
+		case 5:
+			if b, ok := g.bind(bound); ok {
+				ret = append(ret, b)
+			}
+		case 6:
+			inner := make(map[string]bool)
+			for k := range bound {
+				inner[k] = true
+			}
+			first := g.has(inner, g.c.intn(2) == 0)
+			ncc := NewNccRule(append([]interface{}{first}, g.items(inner, 2, depth+1)...)...)
+			ret = append(ret, ncc)
+		case 7:
+			inner := make(map[string]bool)
+			for k := range bound {
+				inner[k] = true
+			}
+			cond := g.has(inner, false)
+			first := g.has(inner, g.c.intn(2) == 0)
+			requirements := append([]interface{}{first}, g.items(inner, 2, depth+1)...)
+			ret = append(ret, NewForall(cond, requirements...))
+		}
+	}
+	return ret
+}
+
+// production always starts with a positive condition: the network has no
+// dummy top token, so a leading negation or filter is never activated.
+func (g *fuzzGen) production() LHS {
+	bound := make(map[string]bool)
+	first := g.has(bound, false)
+	return NewLHS(append([]interface{}{first}, g.items(bound, 5, 0)...)...)
+}
+
+func naiveTestWme(c Has, w *WME, env Env) bool {
+	if !c.testWme(w) {
+		return false
+	}
+	for idx, v := range c.fields {
+		if !isVar(v) {
+			continue
+		}
+		if b, ok := env[varKey(v)]; ok && bindingString(b) != w.fields[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// naiveMatch calls emit with every chain of WMEs satisfying items under env by
+// nested loops over wm. The chain follows the network's token layout:
+// positive conditions add their WME, negations add nil, filters and binds add
+// nothing.
+func naiveMatch(items []interface{}, wm []*WME, env Env, chain []*WME, emit func([]*WME, Env)) {
+	if len(items) == 0 {
+		emit(chain, env)
+		return
+	}
+	extend := func(w *WME) []*WME {
+		return append(append([]*WME(nil), chain...), w)
+	}
+	rest := items[1:]
+	switch cond := items[0].(type) {
+	case Has:
+		if cond.negative {
+			for _, w := range wm {
+				if naiveTestWme(cond, w, env) {
+					return
+				}
+			}
+			naiveMatch(rest, wm, env, extend(nil), emit)
+			return
+		}
+		for _, w := range wm {
+			if !naiveTestWme(cond, w, env) {
+				continue
+			}
+			b := make(Env)
+			for k, v := range env {
+				b[k] = v
+			}
+			for idx, v := range cond.fields {
+				if isVar(v) {
+					b[varKey(v)] = w.fields[idx]
+				}
+			}
+			naiveMatch(rest, wm, b, extend(w), emit)
+		}
+	case Exists:
+		for _, w := range wm {
+			if naiveTestWme(cond.Has, w, env) {
+				naiveMatch(rest, wm, env, extend(nil), emit)
+				return
+			}
+		}
+	case Accumulate:
+		acc := cond.reducer()
+		for _, w := range wm {
+			if naiveTestWme(cond.Has, w, env) {
+				if idx := cond.contain(cond.of); idx != -1 {
+					acc.Add(w.fields[idx])
+				} else {
+					acc.Add("")
+				}
+			}
+		}
+		if r := acc.Result(); r != nil {
+			b := make(Env)
+			for k, v := range env {
+				b[k] = v
+			}
+			b[varKey(cond.result)] = r
+			naiveMatch(rest, wm, b, extend(nil), emit)
+		}
+	case Collect:
+		var wmes []*WME
+		values := []string{}
+		for _, w := range wm {
+			if naiveTestWme(cond.Has, w, env) {
+				wmes = append(wmes, w)
+				if idx := cond.contain(cond.of); idx != -1 {
+					values = append(values, w.fields[idx])
+				}
+			}
+		}
+		b := make(Env)
+		for k, v := range env {
+			b[k] = v
+		}
+		if cond.contain(cond.of) != -1 {
+			b[varKey(cond.result)] = values
+		} else {
+			b[varKey(cond.result)] = append([]*WME{}, wmes...)
+		}
+		naiveMatch(rest, wm, b, extend(nil), emit)
+	case Filter:
+		result, err := EvalFromString(cond.tmpl, env)
+		if err == nil && len(result) > 0 && result[0].Kind() == reflect.Bool && result[0].Bool() {
+			naiveMatch(rest, wm, env, chain, emit)
+		}
+	case Bind:
+		e, err := Compile(cond.tmpl)
+		if err != nil {
+			return
+		}
+		result, err := e.Eval(env)
+		if err != nil {
+			return
+		}
+		b := make(Env)
+		for k, v := range env {
+			b[k] = v
+		}
+		b[varKey(cond.variable)] = result
+		naiveMatch(rest, wm, b, chain, emit)
+	case LHS:
+		found := false
+		naiveMatch(cond.items, wm, env, nil, func([]*WME, Env) { found = true })
+		if !found {
+			naiveMatch(rest, wm, env, extend(nil), emit)
+		}
+	case Forall:
+		holds := true
+		naiveMatch([]interface{}{cond.cond}, wm, env, nil, func(_ []*WME, b Env) {
+			found := false
+			naiveMatch(cond.requirements, wm, b, nil, func([]*WME, Env) { found = true })
+			holds = holds && found
+		})
+		if holds {
+			naiveMatch(rest, wm, env, extend(nil), emit)
+		}
+	}
+}
+
+func chainKey(ws []*WME) string {
+	var ret []string
+	for _, w := range ws {
+		if w == nil {
+			ret = append(ret, "<nil>")
+		} else {
+			ret = append(ret, fmt.Sprintf("%p%s", w, w))
+		}
+	}
+	return strings.Join(ret, ", ")
+}
+
+// compareWithNaive reports the first P-node whose tokens differ from what the
+// brute-force matcher finds over wm.
+func compareWithNaive(lhs LHS, p *BetaMemory, wm []*WME) error {
+	var want, got []string
+	naiveMatch(lhs.items, wm, make(Env), nil, func(chain []*WME, _ Env) {
+		want = append(want, chainKey(chain))
+	})
+	for e := p.GetItems().Front(); e != nil; e = e.Next() {
+		got = append(got, chainKey(e.Value.(*Token).get_wmes()))
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if strings.Join(want, "\n") != strings.Join(got, "\n") {
+		return fmt.Errorf("production %s\nnetwork:\n\t%s\nnaive:\n\t%s",
+			describe(lhs), strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+	return nil
+}
+
+// runDifferential replays the decisions in data against a fresh network.
+// Productions are added either up front or in the middle of the sequence and
+// may be removed again. Every step is checked against the brute-force matcher.
+func runDifferential(data []byte) error {
+	g := &fuzzGen{c: &choices{data: data}}
+	n := NewNetwork()
+	var pending, added []LHS
+	var pNodes []*BetaMemory
+	var wm []*WME
+	var log []string
+
+	addProduction := func(lhs LHS) error {
+		p, err := n.AddProduction(lhs, NewRHS())
+		if err != nil {
+			return fmt.Errorf("add %s: %w", describe(lhs), err)
+		}
+		pNodes = append(pNodes, p)
+		added = append(added, lhs)
+		log = append(log, "add "+describe(lhs))
+		return nil
+	}
+	check := func() error {
+		for i, lhs := range added {
+			if err := compareWithNaive(lhs, pNodes[i], wm); err != nil {
+				return fmt.Errorf("after\n\t%s\n%s", strings.Join(log, "\n\t"), err)
+			}
+		}
+		return nil
+	}
+
+	for i := 1 + g.c.intn(3); i > 0; i-- {
+		lhs := g.production()
+		if g.c.intn(2) == 0 {
+			if err := addProduction(lhs); err != nil {
+				return err
+			}
+		} else {
+			pending = append(pending, lhs)
+		}
+	}
+	for step := 5 + g.c.intn(40); step > 0; step-- {
+		switch op := g.c.intn(6); {
+		case op == 5 && len(added) > 0:
+			idx := g.c.intn(len(added))
+			if err := n.RemoveProduction(pNodes[idx]); err != nil {
+				return err
+			}
+			log = append(log, "remove "+describe(added[idx]))
+			added = append(added[:idx:idx], added[idx+1:]...)
+			pNodes = append(pNodes[:idx:idx], pNodes[idx+1:]...)
+		case op == 4 && len(pending) > 0:
+			if err := addProduction(pending[0]); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		case op == 3 && len(wm) > 0:
+			idx := g.c.intn(len(wm))
+			w := wm[idx]
+			wm = append(wm[:idx:idx], wm[idx+1:]...)
+			RemoveWME(w)
+			log = append(log, fmt.Sprintf("retract %s", w))
+		default:
+			w := g.wme()
+			wm = append(wm, w)
+			n.AddWME(w)
+			log = append(log, fmt.Sprintf("assert %s", w))
+		}
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	for _, lhs := range pending {
+		if err := addProduction(lhs); err != nil {
+			return err
+		}
+	}
+	if err := check(); err != nil {
+		return err
+	}
+	for _, p := range pNodes {
+		if err := n.RemoveProduction(p); err != nil {
+			return err
+		}
+	}
+	return checkEmptyNetwork(n, wm)
+}
+
+// checkEmptyNetwork reports anything left behind once every production has
+// been removed: only the working memory should still reference the WMEs.
+func checkEmptyNetwork(n *Network, wm []*WME) error {
+	if n.alphaRoot.children.Len() != 0 || n.betaRoot.GetChildren().Len() != 0 || len(n.PNodes) != 0 {
+		return errors.New("nodes left after removing every production")
+	}
+	for _, w := range wm {
+		if w.tokens.Len() != 0 || w.negativeJoinResults.Len() != 0 || w.alphaMems.Len() != 1 {
+			return fmt.Errorf("%s still referenced after removing every production", w)
+		}
+	}
+	return nil
+}
+
+func TestDifferentialAgainstNaive(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		data := make([]byte, 128)
+		rnd.Read(data)
+		if err := runDifferential(data); err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+	}
+}
+
+func FuzzDifferentialAgainstNaive(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("\x02\x00\x01\x03\x01\x02\x01\x00\x01\x02\x03"))
+	f.Add([]byte("\x01\x01\x00\x04\x03\x01\x02\x01\x00\x00\x02\x01\x01\x03\x00\x01"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := runDifferential(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -1,143 +1,823 @@
 package rete
 
 import (
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"math"
+	"math/big"
 	"reflect"
-	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
+// Expression is a filter expression parsed and compiled once into closures,
+// so that evaluating it only walks the compiled form.
+type Expression struct {
+	src   string
+	ast   ast.Expr
+	depth int
+	eval  evaluator
+}
+
+type evaluator func(c *evalContext) (interface{}, error)
+
+// evalOptions are the settings of a network that its filter and bind nodes
+// evaluate with.
+type evalOptions struct {
+	clock     func() time.Time
+	decimal   *DecimalMode
+	limits    *evalLimits
+	functions map[string]Function
+}
+
+// isFunction tells whether name is a function of the network or the package.
+func (options *evalOptions) isFunction(name string) bool {
+	return options.functions[name] != nil || isFunction(name)
+}
+
+// evalContext is the state of one evaluation.
+type evalContext struct {
+	env       Env
+	clock     func() time.Time
+	decimal   *DecimalMode
+	limits    *evalLimits
+	functions map[string]Function
+	// ops and deadline are only kept under limits
+	ops      int
+	deadline time.Time
+}
+
+// Compile parses a Go expression. Variables may be written with the `$`
+// prefix used in conditions. Besides Go syntax, `[a, b]` is a list and
+// `x in y` tells whether x is an element of the list or a key of the map y.
+// An `in` next to another comparison, or with an operator in y, needs
+// parentheses.
+func Compile(s string) (*Expression, error) {
+	exp, err := parser.ParseExpr(rewriteLists(stripVarPrefix(s)))
+	if err != nil {
+		return nil, restoreNames(err)
+	}
+	if err := checkIn(exp); err != nil {
+		return nil, err
+	}
+	eval, err := compile(exp)
+	if err != nil {
+		return nil, restoreNames(err)
+	}
+	return &Expression{src: s, ast: exp, depth: exprDepth(exp), eval: eval}, nil
+}
+
+func (e *Expression) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression over env. now() reads the system clock.
+func (e *Expression) Eval(env Env) (interface{}, error) {
+	return e.eval(&evalContext{env: env, clock: time.Now})
+}
+
+// evalWith evaluates the expression with the options of a network. A panic
+// of a function it calls is returned as an error.
+func (e *Expression) evalWith(env Env, options *evalOptions) (v interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			v, err = nil, fmt.Errorf("panic: %v", p)
+		}
+	}()
+	c := &evalContext{env: env, clock: time.Now}
+	if options != nil {
+		if options.clock != nil {
+			c.clock = options.clock
+		}
+		c.decimal = options.decimal
+		c.limits = options.limits
+		c.functions = options.functions
+	}
+	if c.limits != nil {
+		if err := c.limits.check(e); err != nil {
+			return nil, err
+		}
+		if c.limits.Timeout > 0 {
+			c.deadline = time.Now().Add(c.limits.Timeout)
+		}
+	}
+	return e.eval(c)
+}
+
+// now is the function now() of the evaluation.
+func (c *evalContext) now(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	return c.clock(), nil
+}
+
 func EvalFromString(s string, env Env) (result []reflect.Value, err error) {
-	exp, err := parser.ParseExpr(s)
+	e, err := Compile(s)
 	if err != nil {
 		return
 	}
-	return Eval(exp, env)
+	return evalToValues(e.eval, env)
 }
 
 func Eval(exp ast.Expr, env Env) (result []reflect.Value, err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			err = fmt.Errorf("%s %s", e, debug.Stack())
+	eval, err := compile(exp)
+	if err != nil {
+		return
+	}
+	return evalToValues(eval, env)
+}
+
+// EvalCall, EvalIdent and EvalBinaryExpr are kept for callers of the
+// uncompiled API, and are the same as Eval.
+func EvalCall(exp *ast.CallExpr, env Env) (result []reflect.Value, err error) {
+	return Eval(exp, env)
+}
+
+func EvalIdent(exp *ast.Ident, env Env) (result []reflect.Value, err error) {
+	return Eval(exp, env)
+}
+
+func EvalBinaryExpr(exp *ast.BinaryExpr, env map[string]interface{}) (result []reflect.Value, err error) {
+	return Eval(exp, env)
+}
+
+func evalToValues(eval evaluator, env Env) ([]reflect.Value, error) {
+	r, err := eval(&evalContext{env: env, clock: time.Now})
+	if err != nil {
+		return nil, err
+	}
+	return []reflect.Value{reflect.ValueOf(r)}, nil
+}
+
+// stripVarPrefix drops the `$` in front of identifiers outside string and
+// rune literals.
+func stripVarPrefix(s string) string {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' && i+1 < len(s) {
+				b.WriteByte(c)
+				i++
+				c = s[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '$' && i+1 < len(s) && (s[i+1] == '_' || unicode.IsLetter(rune(s[i+1]))):
+			continue
 		}
-	}()
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func compile(exp ast.Expr) (evaluator, error) {
 	switch exp := exp.(type) {
-	case *ast.BinaryExpr:
-		return EvalBinaryExpr(exp, env)
 	case *ast.BasicLit:
 		var r interface{}
+		var err error
 		switch exp.Kind {
 		case token.INT, token.FLOAT:
-			r, err = strconv.ParseFloat(exp.Value, 64)
+			var f float64
+			if f, err = strconv.ParseFloat(exp.Value, 64); err != nil {
+				return nil, err
+			}
+			d, ok := asRat(exp.Value)
+			if !ok {
+				d, _ = asRat(f)
+			}
+			return func(c *evalContext) (interface{}, error) {
+				if c.decimal != nil {
+					return Decimal{d}, nil
+				}
+				return f, nil
+			}, nil
 		case token.STRING:
 			r, err = strconv.Unquote(exp.Value)
+		default:
+			err = fmt.Errorf("literal %s not supported", exp.Value)
 		}
 		if err != nil {
-			return
+			return nil, err
 		}
-		result = append(result, reflect.ValueOf(r))
-		return result, nil
+		return func(*evalContext) (interface{}, error) { return r, nil }, nil
+	case *ast.ParenExpr:
+		return compile(exp.X)
+	case *ast.Ident:
+		name := exp.Name
+		return func(c *evalContext) (interface{}, error) { return lookup(c, name) }, nil
 	case *ast.UnaryExpr:
-		switch exp.Op {
-		case token.ADD:
-			return Eval(exp.X, env)
-		case token.SUB:
-			result, err = Eval(exp.X, env)
+		return compileUnaryExpr(exp)
+	case *ast.BinaryExpr:
+		return compileBinaryExpr(exp)
+	case *ast.CallExpr:
+		return compileCallExpr(exp)
+	case *ast.SelectorExpr:
+		x, err := compile(exp.X)
+		if err != nil {
+			return nil, err
+		}
+		name := exp.Sel.Name
+		return func(c *evalContext) (interface{}, error) {
+			v, err := x(c)
 			if err != nil {
-				return
+				return nil, err
 			}
-			val := -result[0].Float()
-			result = []reflect.Value{reflect.ValueOf(val)}
-			return
+			if err := c.step(); err != nil {
+				return nil, err
+			}
+			return member(v, name)
+		}, nil
+	case *ast.IndexExpr:
+		x, err := compile(exp.X)
+		if err != nil {
+			return nil, err
 		}
-	case *ast.ParenExpr:
-		return Eval(exp.X, env)
-	case *ast.Ident:
-		return EvalIdent(exp, env)
-	case *ast.CallExpr:
-		return EvalCall(exp, env)
+		i, err := compile(exp.Index)
+		if err != nil {
+			return nil, err
+		}
+		return binary(x, i, func(c *evalContext, v, k interface{}) (interface{}, error) {
+			return index(v, k)
+		}), nil
+	case *ast.CompositeLit:
+		return compileCompositeLit(exp)
 	}
+	return nil, fmt.Errorf("expression %T not supported", exp)
+}
 
-	return
+// lookup resolves an identifier to a binding, then to the constants true and
+// false and the function now, then to a function registered on the network,
+// then to one registered on the package.
+func lookup(c *evalContext, name string) (interface{}, error) {
+	if v := c.env[name]; v != nil {
+		return v, nil
+	}
+	switch name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "now":
+		return Function(c.now), nil
+	}
+	if f, ok := c.functions[name]; ok {
+		return f, nil
+	}
+	if f, err := GetFunction(name); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("ident `%s` undefined", name)
 }
 
-func EvalCall(exp *ast.CallExpr, env Env) (result []reflect.Value, err error) {
-	f_val, err := Eval(exp.Fun, env)
+func compileUnaryExpr(exp *ast.UnaryExpr) (evaluator, error) {
+	x, err := compile(exp.X)
 	if err != nil {
-		return
+		return nil, err
+	}
+	switch exp.Op {
+	case token.ADD:
+		return x, nil
+	case token.SUB:
+		return func(c *evalContext) (interface{}, error) {
+			v, err := x(c)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.step(); err != nil {
+				return nil, err
+			}
+			if d, ok := asRat(v); ok && c.decimal != nil {
+				return Decimal{new(big.Rat).Neg(d)}, nil
+			}
+			f, err := value2float(v)
+			if err != nil {
+				return nil, err
+			}
+			return -f, nil
+		}, nil
+	case token.NOT:
+		return func(c *evalContext) (interface{}, error) {
+			v, err := x(c)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.step(); err != nil {
+				return nil, err
+			}
+			b, err := value2bool(v)
+			if err != nil {
+				return nil, err
+			}
+			return !b, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("OP `%s` undefined", exp.Op)
+}
+
+// compileBinaryExpr compiles arithmetic, comparisons and the short-circuit
+// operators && and ||. WME values are strings, so a string that parses as a
+// number is a number here; two strings that do not are compared as strings.
+// Next to a time or a duration, a string is parsed as one.
+func compileBinaryExpr(exp *ast.BinaryExpr) (evaluator, error) {
+	x, err := compile(exp.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := compile(exp.Y)
+	if err != nil {
+		return nil, err
+	}
+	op := exp.Op
+	switch op {
+	case token.LAND, token.LOR:
+		return func(c *evalContext) (interface{}, error) {
+			l, err := x(c)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.step(); err != nil {
+				return nil, err
+			}
+			left, err := value2bool(l)
+			if err != nil {
+				return nil, err
+			}
+			if left == (op == token.LOR) {
+				return left, nil
+			}
+			r, err := y(c)
+			if err != nil {
+				return nil, err
+			}
+			return value2bool(r)
+		}, nil
+	case token.EQL, token.NEQ:
+		return binary(x, y, func(c *evalContext, l, r interface{}) (interface{}, error) {
+			if m, ok := r.(membership); ok {
+				in, err := m.contains(l)
+				return in == (op == token.EQL), err
+			}
+			if a, b, ok := decimalOperands(c, l, r); ok {
+				return (a.Cmp(b) == 0) == (op == token.EQL), nil
+			}
+			eq, err := equalValues(l, r)
+			return eq == (op == token.EQL), err
+		}), nil
+	case token.GTR, token.LSS, token.GEQ, token.LEQ:
+		return binary(x, y, func(c *evalContext, l, r interface{}) (interface{}, error) {
+			var cmp int
+			var err error
+			if a, b, ok := decimalOperands(c, l, r); ok {
+				cmp = a.Cmp(b)
+			} else {
+				cmp, err = compareValues(l, r)
+			}
+			switch op {
+			case token.GTR:
+				return cmp > 0, err
+			case token.LSS:
+				return cmp < 0, err
+			case token.GEQ:
+				return cmp >= 0, err
+			}
+			return cmp <= 0, err
+		}), nil
+	case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+		return binary(x, y, func(c *evalContext, l, r interface{}) (interface{}, error) {
+			if a, b, ok := decimalOperands(c, l, r); ok {
+				return decimalArithmetic(c.decimal, op, a, b)
+			}
+			return arithmetic(op, l, r)
+		}), nil
 	}
-	var args_val []reflect.Value
-	for _, arg := range exp.Args {
-		arg_val, err := Eval(arg, env)
+	return nil, fmt.Errorf("OP `%s` undefined", op)
+}
+
+func binary(x, y evaluator, f func(c *evalContext, l, r interface{}) (interface{}, error)) evaluator {
+	return func(c *evalContext) (interface{}, error) {
+		l, err := x(c)
 		if err != nil {
-			return result, err
+			return nil, err
 		}
-		args_val = append(args_val, arg_val[0])
+		r, err := y(c)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.step(); err != nil {
+			return nil, err
+		}
+		r, err = f(c, l, r)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
 	}
-	result = f_val[0].Call(args_val)
-	return
 }
 
-func EvalIdent(exp *ast.Ident, env Env) (result []reflect.Value, err error) {
-	v := env[exp.Name]
-	if v == nil {
-		err = fmt.Errorf("ident `%s` undefined", exp)
-	} else {
-		result = append(result, reflect.ValueOf(v))
+func compileCallExpr(exp *ast.CallExpr) (evaluator, error) {
+	args := make([]evaluator, len(exp.Args))
+	var err error
+	for i, arg := range exp.Args {
+		if args[i], err = compile(arg); err != nil {
+			return nil, err
+		}
+	}
+	if fun, ok := exp.Fun.(*ast.Ident); ok {
+		switch fun.Name {
+		case listFunction:
+			return compileList(args), nil
+		case inFunction:
+			if len(args) != 1 {
+				return nil, fmt.Errorf("OP `in` needs one operand")
+			}
+			return func(c *evalContext) (interface{}, error) {
+				v, err := args[0](c)
+				if err != nil {
+					return nil, err
+				}
+				return membership{v}, nil
+			}, nil
+		}
+	}
+	fun, err := compile(exp.Fun)
+	if err != nil {
+		return nil, err
 	}
-	return
+	name := fmt.Sprint(exp.Fun)
+	return func(c *evalContext) (interface{}, error) {
+		f, err := fun(c)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			if values[i], err = arg(c); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.call(name); err != nil {
+			return nil, err
+		}
+		return c.invoke(name, func() (interface{}, error) {
+			if f, ok := f.(Function); ok {
+				r, err := f(values...)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+				return r, nil
+			}
+			return callValue(name, f, values)
+		})
+	}, nil
 }
 
-func EvalBinaryExpr(exp *ast.BinaryExpr, env map[string]interface{}) (result []reflect.Value, err error) {
-	leftResult, err := Eval(exp.X, env)
+// compileCompositeLit compiles slice, array and map literals. Their elements
+// are not converted to the element type.
+func compileCompositeLit(exp *ast.CompositeLit) (evaluator, error) {
+	switch exp.Type.(type) {
+	case *ast.ArrayType:
+		elts := make([]evaluator, len(exp.Elts))
+		for i, elt := range exp.Elts {
+			if _, ok := elt.(*ast.KeyValueExpr); ok {
+				return nil, fmt.Errorf("indexed list elements not supported")
+			}
+			var err error
+			if elts[i], err = compile(elt); err != nil {
+				return nil, err
+			}
+		}
+		return compileList(elts), nil
+	case *ast.MapType:
+		keys := make([]evaluator, len(exp.Elts))
+		values := make([]evaluator, len(exp.Elts))
+		for i, elt := range exp.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				return nil, fmt.Errorf("map element without key")
+			}
+			var err error
+			if keys[i], err = compile(kv.Key); err != nil {
+				return nil, err
+			}
+			if values[i], err = compile(kv.Value); err != nil {
+				return nil, err
+			}
+		}
+		return func(c *evalContext) (interface{}, error) {
+			m := make(map[string]interface{}, len(keys))
+			for i := range keys {
+				k, err := keys[i](c)
+				if err != nil {
+					return nil, err
+				}
+				v, err := values[i](c)
+				if err != nil {
+					return nil, err
+				}
+				m[bindingString(k)] = v
+			}
+			return m, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("literal of %T not supported", exp.Type)
+}
+
+func compileList(elts []evaluator) evaluator {
+	return func(c *evalContext) (interface{}, error) {
+		if err := c.step(); err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, len(elts))
+		for i, elt := range elts {
+			v, err := elt(c)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	}
+}
+
+// callValue calls a Go function placed in the Env.
+func callValue(name string, f interface{}, args []interface{}) (r interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%s: %v", name, e)
+		}
+	}()
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		in[i] = reflect.ValueOf(arg)
+	}
+	out := reflect.ValueOf(f).Call(in)
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out[0].Interface(), nil
+}
+
+func arithmetic(op token.Token, l, r interface{}) (interface{}, error) {
+	if isTemporal(l) || isTemporal(r) {
+		return temporalArithmetic(op, l, r)
+	}
+	left, err := value2float(l)
 	if err != nil {
-		return
+		return nil, err
 	}
-	rightResult, err := Eval(exp.Y, env)
+	right, err := value2float(r)
 	if err != nil {
-		return
+		return nil, err
 	}
-	var r interface{}
-	left := value2float(leftResult[0])
-	right := value2float(rightResult[0])
-
-	switch exp.Op {
-	case token.GTR:
-		r = left > right
-	case token.LSS:
-		r = left < right
-	case token.GEQ:
-		r = left >= right
-	case token.LEQ:
-		r = left <= right
-	case token.EQL:
-		r = left == right
+	switch op {
 	case token.ADD:
-		r = left + right
+		return left + right, nil
 	case token.SUB:
-		r = left - right
+		return left - right, nil
+	case token.MUL:
+		return left * right, nil
+	}
+	if right == 0 {
+		return nil, errors.New("division by zero")
+	}
+	if op == token.QUO {
+		return left / right, nil
+	}
+	return math.Mod(left, right), nil
+}
+
+func equalValues(l, r interface{}) (bool, error) {
+	if isTemporal(l) || isTemporal(r) {
+		c, err := compareTemporal(l, r)
+		return c == 0, err
+	}
+	if left, ok := asFloat(l); ok {
+		if right, ok := asFloat(r); ok {
+			return left == right, nil
+		}
+	}
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		return ls == rs, nil
+	}
+	_, lb := l.(bool)
+	_, rb := r.(bool)
+	if lb || rb {
+		left, lerr := value2bool(l)
+		right, rerr := value2bool(r)
+		if lerr == nil && rerr == nil {
+			return left == right, nil
+		}
+	}
+	return false, fmt.Errorf("cannot compare %s and %s", describeValue(l), describeValue(r))
+}
+
+func compareValues(l, r interface{}) (int, error) {
+	if isTemporal(l) || isTemporal(r) {
+		return compareTemporal(l, r)
+	}
+	if left, ok := asFloat(l); ok {
+		if right, ok := asFloat(r); ok {
+			switch {
+			case left < right:
+				return -1, nil
+			case left > right:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		return strings.Compare(ls, rs), nil
+	}
+	return 0, fmt.Errorf("cannot order %s and %s", describeValue(l), describeValue(r))
+}
+
+func isTemporal(v interface{}) bool {
+	switch v.(type) {
+	case time.Time, time.Duration:
+		return true
+	}
+	return false
+}
+
+// timeLayouts are the formats a string converts to a time from.
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"}
+
+func asTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func asDuration(v interface{}) (time.Duration, bool) {
+	switch v := v.(type) {
+	case time.Duration:
+		return v, true
+	case string:
+		d, err := time.ParseDuration(v)
+		return d, err == nil
+	}
+	return 0, false
+}
+
+// compareTemporal compares two times or two durations. A string converts to
+// the type of the other operand.
+func compareTemporal(l, r interface{}) (int, error) {
+	if left, ok := asTime(l); ok {
+		if right, ok := asTime(r); ok {
+			return left.Compare(right), nil
+		}
+	}
+	if left, ok := asDuration(l); ok {
+		if right, ok := asDuration(r); ok {
+			switch {
+			case left < right:
+				return -1, nil
+			case left > right:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s and %s", describeValue(l), describeValue(r))
+}
+
+// temporalArithmetic subtracts times, moves a time by a duration, adds or
+// subtracts durations, and scales durations by numbers. A string converts to
+// a time or a duration, whichever it parses as.
+func temporalArithmetic(op token.Token, l, r interface{}) (interface{}, error) {
+	lt, lIsTime := asTime(l)
+	rt, rIsTime := asTime(r)
+	ld, lIsDuration := asDuration(l)
+	rd, rIsDuration := asDuration(r)
+	switch {
+	case op == token.SUB && lIsTime && rIsTime:
+		return lt.Sub(rt), nil
+	case op == token.ADD && lIsTime && rIsDuration:
+		return lt.Add(rd), nil
+	case op == token.ADD && lIsDuration && rIsTime:
+		return rt.Add(ld), nil
+	case op == token.SUB && lIsTime && rIsDuration:
+		return lt.Add(-rd), nil
+	case op == token.ADD && lIsDuration && rIsDuration:
+		return ld + rd, nil
+	case op == token.SUB && lIsDuration && rIsDuration:
+		return ld - rd, nil
+	case op == token.QUO && lIsDuration && rIsDuration:
+		if rd == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return float64(ld) / float64(rd), nil
+	}
+	if _, isDuration := l.(time.Duration); isDuration {
+		if x, ok := asFloat(r); ok {
+			return scaleDuration(op, ld, x)
+		}
+	}
+	if _, isDuration := r.(time.Duration); isDuration && op == token.MUL {
+		if x, ok := asFloat(l); ok {
+			return scaleDuration(op, rd, x)
+		}
+	}
+	return nil, fmt.Errorf("OP `%s` on %s and %s", op, describeValue(l), describeValue(r))
+}
+
+func scaleDuration(op token.Token, d time.Duration, x float64) (interface{}, error) {
+	switch op {
 	case token.MUL:
-		r = left * right
+		return time.Duration(float64(d) * x), nil
 	case token.QUO:
-		r = left / right
-	default:
-		err = fmt.Errorf("OP `%s` undefined", exp.Op)
-		return
+		if x == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return time.Duration(float64(d) / x), nil
+	}
+	return nil, fmt.Errorf("OP `%s` on %s", op, describeValue(d))
+}
+
+// isDecimalLiteral tells whether s may be a finite decimal number, so that
+// strings such as "NaN", "Inf" or "0x1p4" are not taken for numbers.
+func isDecimalLiteral(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789+-.eE") == ""
+}
+
+func asFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		if !isDecimalLiteral(v) {
+			return 0, false
+		}
+		r, err := strconv.ParseFloat(v, 64)
+		return r, err == nil
+	case int:
+		return float64(v), true
+	case Decimal:
+		return v.Float64(), true
+	case nil, bool, time.Duration:
+		return 0, false
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+func value2float(v interface{}) (float64, error) {
+	if r, ok := asFloat(v); ok {
+		return r, nil
+	}
+	return 0, fmt.Errorf("%s is not a number", describeValue(v))
+}
+
+func value2bool(v interface{}) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		if r, err := strconv.ParseBool(v); err == nil {
+			return r, nil
+		}
 	}
-	result = append(result, reflect.ValueOf(r))
-	return result, nil
+	return false, fmt.Errorf("%s is not a bool", describeValue(v))
 }
 
-func value2float(v reflect.Value) float64 {
-	switch v.Kind() {
-	case reflect.Float64:
-		return v.Float()
-	case reflect.String:
-		r, _ := strconv.ParseFloat(v.String(), 64)
-		return r
+func describeValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return strconv.Quote(v)
 	}
-	return v.Float()
+	return fmt.Sprintf("%v (%T)", v, v)
 }
@@ -2,7 +2,9 @@ package rete
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 func F(a string, b string) map[string]interface{} {
@@ -22,3 +24,287 @@ func TestEvalFromString(t *testing.T) {
 		fmt.Println("eval result:", result[0])
 	}
 }
+
+func TestEvalBinaryExpr(t *testing.T) {
+	env := Env{"name": "B1", "qty": "10", "flag": "true", "price": 2.5, "s": "NaN"}
+	expect := map[string]interface{}{
+		`$name == "B1" && $qty > 3`: true,
+		`name != "B1" || qty > 30`:  false,
+		`$qty > 9`:                  true,
+		`$qty % 4`:                  2.0,
+		`"B10" < "B9"`:              true,
+		`$name < "B2"`:              true,
+		`$qty == "10.0"`:            true,
+		`!$flag`:                    false,
+		`flag == true`:              true,
+		`price * -2`:                -5.0,
+		`"$name" == "B1"`:           false,
+		`$s == "NaN"`:               true,
+		`$s != $s`:                  false,
+		`"Inf" == "inf"`:            false,
+	}
+	for s, want := range expect {
+		result, err := EvalFromString(s, env)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if got := result[0].Interface(); got != want {
+			t.Errorf("%s: expected %v, got %v", s, want, got)
+		}
+	}
+	// the right operand is not evaluated
+	for _, s := range []string{`false && missing`, `true || missing`} {
+		if _, err := EvalFromString(s, env); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+	for _, s := range []string{`$name > 3`, `$name + 1`, `$qty && true`, `!$qty`, `$qty % 0`, `$name == 1`, `"inf" > 5`, `"0x1p4" + 1`} {
+		if _, err := EvalFromString(s, env); err == nil {
+			t.Errorf("%s: expected type error", s)
+		}
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	env := Env{"name": "Bob", "qty": "-2.345", "tags": []string{"vip", "new"}}
+	expect := map[string]interface{}{
+		`len($name)`:                 3.0,
+		`len($tags)`:                 2.0,
+		`upper($name) == "BOB"`:      true,
+		`lower($name)`:               "bob",
+		`contains($name, "ob")`:      true,
+		`contains($tags, "vip")`:     true,
+		`startsWith($name, "Bo")`:    true,
+		`matches($name, "^B[a-z]+")`: true,
+		`abs($qty)`:                  2.345,
+		`min(3, $qty, 1)`:            -2.345,
+		`max(3, $qty, 1)`:            3.0,
+		`round($qty, 2)`:             -2.35,
+		`round(2.5)`:                 3.0,
+		`round($qty, 1e9)`:           -2.345,
+		`round($qty, -1e9)`:          -0.0,
+		`double($qty)`:               -4.69,
+	}
+	options := &evalOptions{functions: map[string]Function{
+		"double": func(args ...interface{}) (interface{}, error) {
+			x, err := argFloat(args[0])
+			return 2 * x, err
+		},
+	}}
+	for s, want := range expect {
+		e, err := Compile(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := e.evalWith(env, options); err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if got != want {
+			t.Errorf("%s: expected %v, got %v", s, want, got)
+		}
+	}
+	if _, err := EvalFromString(`double(1)`, env); err == nil {
+		t.Error("expected functions of a network to be unknown elsewhere")
+	}
+	for _, s := range []string{`len(3)`, `upper(1)`, `matches($name, "(")`, `abs()`, `round(1, 0.5)`, `undefined(1)`} {
+		if _, err := EvalFromString(s, env); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+	if _, err := GetFunction("now"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPatternCache(t *testing.T) {
+	for i := 0; i < 2*maxPatterns; i++ {
+		if _, err := matches("a1", fmt.Sprintf("a%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := patterns.order.Len(); got != maxPatterns {
+		t.Errorf("expected %d cached patterns, got %d", maxPatterns, got)
+	}
+	if got, _ := matches("a1", "a1"); got != true {
+		t.Errorf("expected a dropped pattern to compile again, got %v", got)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	e, err := Compile(`$qty * 2 > limit`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for qty, want := range map[string]bool{"1": false, "3": true} {
+		got, err := e.Eval(Env{"qty": qty, "limit": 5.0})
+		if err != nil || got != want {
+			t.Errorf("qty %s: expected %v, got %v (%v)", qty, want, got, err)
+		}
+	}
+	if _, err := e.Eval(Env{"qty": "1"}); err == nil {
+		t.Error("expected error for unbound limit")
+	}
+	for _, s := range []string{`a +`, `a[0`, `a & b`, `'c'`, `a in`, `[]int{1: 2}`, `x in )`, `[1 2]`,
+		`$a < $b in $c`, `$a in $b == true`, `$a in $b in $c`, `$a in $b + 1`} {
+		if _, err := Compile(s); err == nil {
+			t.Errorf("%s: expected compile error", s)
+		} else if strings.Contains(err.Error(), "__") {
+			t.Errorf("%s: internal name in %v", s, err)
+		}
+	}
+}
+
+func TestEvalAccess(t *testing.T) {
+	type user struct {
+		Tier string
+		age  int
+	}
+	env := Env{
+		"user":  map[string]interface{}{"tier": "gold", "tags": []interface{}{"new", "vip"}},
+		"attrs": map[string]string{"region": "eu"},
+		"tags":  []string{"a", "b"},
+		"u":     &user{Tier: "silver"},
+		"ids":   map[int]string{7: "seven"},
+	}
+	expect := map[string]interface{}{
+		`$user.tier`:                          "gold",
+		`$user.tags[1]`:                       "vip",
+		`$user["tier"] == "gold"`:             true,
+		`$tags[0]`:                            "a",
+		`$tags[len($tags) - 1]`:               "b",
+		`$u.Tier`:                             "silver",
+		`$ids[7]`:                             "seven",
+		`$attrs["region"] in ["eu", "us"]`:    true,
+		`$attrs.region in ["us"]`:             false,
+		`"region" in $attrs && 2 in [1, "2"]`: true,
+		`"vip" in $user.tags`:                 true,
+		`len(["a", "b", "c"])`:                3.0,
+		`[]string{"x", "y"}[1]`:               "y",
+		`map[string]int{"a": 1}["a"] in [1]`:  true,
+		`[$tags[0], "c"][0] == "a"`:           true,
+		`(len($tags) < 3) in [true]`:          true,
+		`"b" in ($tags)`:                      true,
+	}
+	for s, want := range expect {
+		got, err := evalExpression(t, s, env)
+		if err != nil || got != want {
+			t.Errorf("%s: expected %v, got %v (%v)", s, want, got, err)
+		}
+	}
+	for s, msg := range map[string]string{
+		`$user.plan`:       "key `plan` missing",
+		`$attrs["city"]`:   `key "city" missing`,
+		`$tags[2]`:         "index 2 out of range [0:2)",
+		`$tags[0.5]`:       "not an integer",
+		`$u.age`:           "field `age` missing",
+		`$user.tier.x`:     "has no member `x`",
+		`3 in 4`:           "is not a list or map",
+		`$tags[0] > ["a"]`: "cannot order",
+	} {
+		_, err := evalExpression(t, s, env)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error %q, got %v", s, msg, err)
+		}
+	}
+}
+
+// evalExpression compiles and evaluates s.
+func evalExpression(t *testing.T, s string, env Env) (interface{}, error) {
+	t.Helper()
+	e, err := Compile(s)
+	if err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return e.Eval(env)
+}
+
+func TestEvalTime(t *testing.T) {
+	env := Env{"created": "2024-01-01T00:00:00Z", "expires": "2024-03-01", "ttl": "36h"}
+	expect := map[string]interface{}{
+		`time($expires) - time($created)`:                                  time.Duration(60*24) * time.Hour,
+		`time($created) + duration("36h") == time("2024-01-02T12:00:00Z")`: true,
+		`time($created) + $ttl > $expires`:                                 false,
+		`before($created, $expires)`:                                       true,
+		`after($created, $expires)`:                                        false,
+		`duration($ttl) * 2 >= duration("72h")`:                            true,
+		`duration($ttl) / duration("12h")`:                                 3.0,
+		`time($expires) - duration("24h") == "2024-02-29"`:                 true,
+	}
+	for s, want := range expect {
+		result, err := EvalFromString(s, env)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if got := result[0].Interface(); got != want {
+			t.Errorf("%s: expected %v, got %v", s, want, got)
+		}
+	}
+	for _, s := range []string{`time("soon")`, `duration("1 day")`, `time($created) + 1`, `time($created) > 5`, `$ttl * duration("1h")`} {
+		if _, err := EvalFromString(s, env); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestDecimalMode(t *testing.T) {
+	for _, c := range []struct {
+		value    string
+		scale    int
+		rounding RoundingMode
+		want     string
+	}{
+		{"2.5", 0, RoundHalfEven, "2"},
+		{"3.5", 0, RoundHalfEven, "4"},
+		{"-2.5", 0, RoundHalfEven, "-2"},
+		{"2.5", 0, RoundHalfUp, "3"},
+		{"-2.5", 0, RoundHalfUp, "-3"},
+		{"2.59", 1, RoundDown, "2.5"},
+		{"-2.51", 1, RoundUp, "-2.6"},
+		{"1.005", 2, RoundHalfEven, "1"},
+	} {
+		d, err := NewDecimal(c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode := &DecimalMode{Scale: c.scale, Rounding: c.rounding}
+		if got := (Decimal{mode.round(d.Rat())}).String(); got != c.want {
+			t.Errorf("round %s to %d places with %d: expected %s, got %s", c.value, c.scale, c.rounding, c.want, got)
+		}
+	}
+	e, err := Compile(`$a + $b == 0.3`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{"a": "0.1", "b": "0.2"}
+	if r, _ := e.Eval(env); r != false {
+		t.Error("expected float64 arithmetic outside decimal mode")
+	}
+	options := &evalOptions{decimal: &DecimalMode{Scale: 4}}
+	if r, err := e.evalWith(env, options); r != true {
+		t.Errorf("expected exact decimals, got %v (%v)", r, err)
+	}
+	for s, want := range map[string]string{
+		`$a * 3 - -0.7`:     "1",
+		`10 / 3`:            "3.3333",
+		`-($a / 8)`:         "-0.0125",
+		`7.5 % 2`:           "1.5",
+		`abs(-$a)`:          "0.1",
+		`min($a, 0.05, $b)`: "0.05",
+		`max($a, $b, 0)`:    "0.2",
+		`round($a + $b, 1)`: "0.3",
+		`round(2.345, 2)`:   "2.35",
+		`round(1250, -2)`:   "1300",
+		`round(2.345, 1e9)`: "2.345",
+		`round(125, -1e9)`:  "0",
+	} {
+		e, err := Compile(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := e.evalWith(env, options)
+		if d, ok := r.(Decimal); !ok || d.String() != want {
+			t.Errorf("%s: expected %s, got %v (%v)", s, want, r, err)
+		}
+	}
+	var zero Decimal
+	if zero.String() != "0" || zero.Float64() != 0 || zero.Rat().Sign() != 0 {
+		t.Errorf("expected the zero Decimal to be 0, got %s", zero)
+	}
+}
@@ -0,0 +1,73 @@
+package rete
+
+import (
+	"container/list"
+)
+
+type ExistsNode struct {
+	parent   IReteNode
+	children *list.List
+	items    *list.List
+	amem     *AlphaMemory
+	tests    *list.List
+}
+
+func (node ExistsNode) GetNodeType() string {
+	return ExistsNodeTy
+}
+func (node ExistsNode) GetParent() IReteNode {
+	return node.parent
+}
+func (node ExistsNode) GetItems() *list.List {
+	return node.items
+}
+func (node *ExistsNode) GetChildren() *list.List {
+	return node.children
+}
+func (node *ExistsNode) LeftActivation(t *Token, w *WME, b Env) {
+	newToken := makeToken(node, t, w, b)
+	node.items.PushBack(newToken)
+
+	newToken.joinResults = list.New()
+	for e := node.amem.items.Front(); e != nil; e = e.Next() {
+		w := e.Value.(*WME)
+		if node.performJoinTests(newToken, w) {
+			jr := &NegativeJoinResult{
+				owner: newToken,
+				wme:   w,
+			}
+			newToken.joinResults.PushBack(jr)
+			w.negativeJoinResults.PushBack(jr)
+		}
+	}
+	if newToken.joinResults.Len() > 0 {
+		for e := node.children.Front(); e != nil; e = e.Next() {
+			child := e.Value.(IReteNode)
+			child.LeftActivation(newToken, nil, nil)
+		}
+	}
+}
+func (node *ExistsNode) RightActivation(w *WME) {
+	for e := node.items.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*Token)
+		if !node.performJoinTests(t, w) {
+			continue
+		}
+		jr := &NegativeJoinResult{
+			owner: t,
+			wme:   w,
+		}
+		t.joinResults.PushBack(jr)
+		w.negativeJoinResults.PushBack(jr)
+		// only the first supporting WME lets the token through
+		if t.joinResults.Len() == 1 {
+			for _e := node.children.Front(); _e != nil; _e = _e.Next() {
+				child := _e.Value.(IReteNode)
+				child.LeftActivation(t, nil, nil)
+			}
+		}
+	}
+}
+func (node *ExistsNode) performJoinTests(t *Token, w *WME) bool {
+	return performJoinTests(node.tests, t, w)
+}
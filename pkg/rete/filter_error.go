@@ -0,0 +1,110 @@
+package rete
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FilterErrorPolicy decides what a filter does when its expression fails to
+// evaluate or does not evaluate to a bool.
+type FilterErrorPolicy int
+
+const (
+	// FilterErrorFalse drops the token, as if the filter were false.
+	FilterErrorFalse FilterErrorPolicy = iota
+	// FilterErrorTrue passes the token, as if the filter were true.
+	FilterErrorTrue
+	// FilterErrorHalt drops the token, records the error and halts the
+	// network, so that ExecuteRules fires nothing more and returns the error.
+	FilterErrorHalt
+	// FilterErrorRecord drops the token and records the error.
+	FilterErrorRecord
+)
+
+// maxFilterErrors bounds the recorded errors; older ones are dropped first.
+const maxFilterErrors = 1000
+
+// FilterError is a failed evaluation of a filter.
+type FilterError struct {
+	Expr     string
+	Bindings Env
+	Err      error
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("filter `%s` with %v: %s", e.Expr, e.Bindings, e.Err)
+}
+
+func (e *FilterError) Unwrap() error {
+	return e.Err
+}
+
+// filterErrors is shared by a network and its filter nodes.
+type filterErrors struct {
+	sync.Mutex
+	policy  FilterErrorPolicy
+	handler func(*FilterError)
+	errors  []*FilterError
+	halted  *FilterError
+}
+
+// report applies the policy to a failed evaluation and returns whether the
+// token passes.
+func (log *filterErrors) report(expr string, bindings Env, err error) bool {
+	e := &FilterError{Expr: expr, Bindings: bindings, Err: err}
+	log.Lock()
+	policy, handler := log.policy, log.handler
+	if policy == FilterErrorHalt || policy == FilterErrorRecord {
+		if len(log.errors) == maxFilterErrors {
+			log.errors = log.errors[1:]
+		}
+		log.errors = append(log.errors, e)
+	}
+	if policy == FilterErrorHalt && log.halted == nil {
+		log.halted = e
+	}
+	log.Unlock()
+	if handler != nil {
+		handler(e)
+	}
+	return policy == FilterErrorTrue
+}
+
+func (log *filterErrors) haltedBy() *FilterError {
+	log.Lock()
+	defer log.Unlock()
+	return log.halted
+}
+
+// SetFilterErrorPolicy sets the policy for filter errors from now on. The
+// default is FilterErrorFalse.
+func (n *Network) SetFilterErrorPolicy(policy FilterErrorPolicy) {
+	n.filterErrors.Lock()
+	defer n.filterErrors.Unlock()
+	n.filterErrors.policy = policy
+}
+
+// OnFilterError sets a callback for every filter error, whatever the policy.
+// It runs while the network is changing, so it must not change the network.
+func (n *Network) OnFilterError(handler func(*FilterError)) {
+	n.filterErrors.Lock()
+	defer n.filterErrors.Unlock()
+	n.filterErrors.handler = handler
+}
+
+// FilterErrors returns the errors recorded under FilterErrorRecord and
+// FilterErrorHalt, oldest first.
+func (n *Network) FilterErrors() []*FilterError {
+	n.filterErrors.Lock()
+	defer n.filterErrors.Unlock()
+	return append([]*FilterError{}, n.filterErrors.errors...)
+}
+
+// ClearFilterErrors forgets the recorded errors and lifts a halt caused by
+// one.
+func (n *Network) ClearFilterErrors() {
+	n.filterErrors.Lock()
+	defer n.filterErrors.Unlock()
+	n.filterErrors.errors = nil
+	n.filterErrors.halted = nil
+}
@@ -2,12 +2,16 @@ package rete
 
 import (
 	"container/list"
+	"fmt"
 )
 
 type FilterNode struct {
 	parent   IReteNode
 	children *list.List
 	tmpl     string
+	expr     *Expression
+	errors   *filterErrors
+	options  *evalOptions
 }
 
 func (node FilterNode) GetNodeType() string {
@@ -29,11 +33,15 @@ func (node *FilterNode) LeftActivation(t *Token, w *WME, b Env) {
 	for k, v := range b {
 		all_binding[k] = v
 	}
-	result, err := EvalFromString(node.tmpl, all_binding)
-	if err != nil || len(result) == 0 {
-		return
+	result, err := node.expr.evalWith(all_binding, node.options)
+	pass, ok := result.(bool)
+	if err == nil && !ok {
+		err = fmt.Errorf("%s is not a bool", describeValue(result))
+	}
+	if err != nil && node.errors != nil {
+		pass = node.errors.report(node.tmpl, all_binding, err)
 	}
-	if !result[0].Bool() {
+	if !pass {
 		return
 	}
 	for e := node.children.Front(); e != nil; e = e.Next() {
@@ -0,0 +1,93 @@
+package rete
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// FiringErrorPolicy decides whether ExecuteRules goes on after a firing
+// fails.
+type FiringErrorPolicy int
+
+const (
+	// ContinueOnError fires the other activations and returns the failures
+	// joined.
+	ContinueOnError FiringErrorPolicy = iota
+	// StopOnError returns the first failure.
+	StopOnError
+)
+
+// FiringError is a failed firing of a production: its actions or its
+// handler returned an error or panicked.
+type FiringError struct {
+	// Production is the name in the RHS Extra, or else the canonical form of
+	// the production.
+	Production string
+	PNode      *BetaMemory
+	Token      *Token
+	Err        error
+}
+
+func (e *FiringError) Error() string {
+	return fmt.Sprintf("production `%s` on %s: %s", e.Production, e.Token, e.Err)
+}
+
+func (e *FiringError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is a panic recovered from a firing: its actions, its template
+// and sink, or its handler.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// SetFiringErrorPolicy sets what ExecuteRules does after a failure. The
+// default is ContinueOnError.
+func (n *Network) SetFiringErrorPolicy(policy FiringErrorPolicy) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.firingPolicy = policy
+}
+
+// SetLogger sets the logger of firing failures. A nil logger, the default,
+// logs nothing.
+func (n *Network) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = discardLogger
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.logger = logger
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func (n *Network) productionName(pNode *BetaMemory) string {
+	if s, ok := pNode.RHS.Extra["name"].(string); ok && s != "" {
+		return s
+	}
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.productionKeys[pNode]
+}
+
+func (n *Network) firingError(pNode *BetaMemory, token *Token, err error) *FiringError {
+	name := n.productionName(pNode)
+	e := &FiringError{Production: name, PNode: pNode, Token: token, Err: err}
+	attrs := []interface{}{"production", name, "token", token.String(), "error", err}
+	if p, ok := err.(*PanicError); ok {
+		attrs = append(attrs, "stack", string(p.Stack))
+	}
+	n.lock.RLock()
+	logger := n.logger
+	n.lock.RUnlock()
+	logger.Error("firing failed", attrs...)
+	return e
+}
@@ -0,0 +1,362 @@
+package rete
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Function can be called from filter expressions. It gets the evaluated
+// arguments, so a WME value arrives as a string.
+type Function func(args ...interface{}) (interface{}, error)
+
+var functionsLock sync.RWMutex
+
+var functions = map[string]Function{
+	"len":        length,
+	"lower":      stringFunction(strings.ToLower),
+	"upper":      stringFunction(strings.ToUpper),
+	"contains":   contains,
+	"startsWith": startsWith,
+	"matches":    matches,
+	"abs":        abs,
+	"min":        extreme(-1),
+	"max":        extreme(1),
+	"round":      round,
+	"now":        now,
+	"duration":   duration,
+	"time":       parseTime,
+	"before":     temporalOrder(-1),
+	"after":      temporalOrder(1),
+}
+
+// RegisterFunction makes f callable by name from every filter expression.
+// Bindings and functions registered on a network take precedence.
+func RegisterFunction(name string, f Function) {
+	functionsLock.Lock()
+	defer functionsLock.Unlock()
+	functions[name] = f
+}
+
+// RegisterFunction makes f callable by name from the filters and binds of
+// the network, before the functions of the package. Productions are checked
+// against the functions registered when they are added.
+func (n *Network) RegisterFunction(name string, f Function) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	functions := make(map[string]Function, len(n.evalOptions.functions)+1)
+	for k, v := range n.evalOptions.functions {
+		functions[k] = v
+	}
+	functions[name] = f
+	n.evalOptions.functions = functions
+}
+
+func GetFunction(name string) (Function, error) {
+	functionsLock.RLock()
+	defer functionsLock.RUnlock()
+	f, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("function `%s` undefined", name)
+	}
+	return f, nil
+}
+
+func isFunction(name string) bool {
+	_, err := GetFunction(name)
+	return err == nil
+}
+
+func checkArgs(args []interface{}, min, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return fmt.Errorf("wrong number of arguments: %d", len(args))
+	}
+	return nil
+}
+
+func argString(arg interface{}) (string, error) {
+	s, ok := arg.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is not a string", describeValue(arg))
+	}
+	return s, nil
+}
+
+func argFloat(arg interface{}) (float64, error) {
+	return value2float(arg)
+}
+
+func length(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if s, ok := args[0].(string); ok {
+		return float64(utf8.RuneCountInString(s)), nil
+	}
+	v := reflect.ValueOf(args[0])
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), nil
+	}
+	return nil, fmt.Errorf("%s has no length", describeValue(args[0]))
+}
+
+func stringFunction(f func(string) string) Function {
+	return func(args ...interface{}) (interface{}, error) {
+		if err := checkArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		s, err := argString(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return f(s), nil
+	}
+}
+
+// contains reports whether a string contains a substring, or a collection an
+// element equal to the second argument.
+func contains(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	if s, ok := args[0].(string); ok {
+		sub, err := argString(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return strings.Contains(s, sub), nil
+	}
+	v := reflect.ValueOf(args[0])
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%s is not a string or list", describeValue(args[0]))
+	}
+	for i := 0; i < v.Len(); i++ {
+		if eq, err := equalValues(v.Index(i).Interface(), args[1]); err == nil && eq {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func startsWith(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	s, err := argString(args[0])
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := argString(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return strings.HasPrefix(s, prefix), nil
+}
+
+// maxPatterns bounds the compiled patterns matches keeps; patterns can come
+// from bindings, so the least recently used are dropped.
+const maxPatterns = 256
+
+type patternEntry struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+var patterns = struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}{entries: make(map[string]*list.Element), order: list.New()}
+
+// compilePattern compiles pattern, or takes it from the cache.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	patterns.Lock()
+	defer patterns.Unlock()
+	if e, ok := patterns.entries[pattern]; ok {
+		patterns.order.MoveToFront(e)
+		return e.Value.(*patternEntry).re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.entries[pattern] = patterns.order.PushFront(&patternEntry{pattern, re})
+	if patterns.order.Len() > maxPatterns {
+		oldest := patterns.order.Remove(patterns.order.Back()).(*patternEntry)
+		delete(patterns.entries, oldest.pattern)
+	}
+	return re, nil
+}
+
+func matches(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	s, err := argString(args[0])
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := argString(args[1])
+	if err != nil {
+		return nil, err
+	}
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(s), nil
+}
+
+// abs, min, max and round return a Decimal when an argument is one.
+func abs(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if rs, ok, err := decimalArgs(args); ok {
+		if err != nil {
+			return nil, err
+		}
+		return Decimal{new(big.Rat).Abs(rs[0])}, nil
+	}
+	x, err := argFloat(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return math.Abs(x), nil
+}
+
+// extreme returns min when sign is -1 and max when it is 1.
+func extreme(sign float64) Function {
+	return func(args ...interface{}) (interface{}, error) {
+		if err := checkArgs(args, 1, -1); err != nil {
+			return nil, err
+		}
+		if rs, ok, err := decimalArgs(args); ok {
+			if err != nil {
+				return nil, err
+			}
+			r := rs[0]
+			for _, x := range rs[1:] {
+				if float64(x.Cmp(r))*sign > 0 {
+					r = x
+				}
+			}
+			return Decimal{new(big.Rat).Set(r)}, nil
+		}
+		var r float64
+		for i, arg := range args {
+			x, err := argFloat(arg)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 || (x-r)*sign > 0 {
+				r = x
+			}
+		}
+		return r, nil
+	}
+}
+
+// maxRoundPlaces bounds the places of round either way.
+const maxRoundPlaces = 100
+
+// round rounds half away from zero to the given whole number of decimal
+// places, 0 by default, kept within maxRoundPlaces.
+func round(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	places := 0.0
+	if len(args) == 2 {
+		var err error
+		if places, err = argFloat(args[1]); err != nil {
+			return nil, err
+		}
+		if places != math.Trunc(places) {
+			return nil, fmt.Errorf("%s is not a whole number of places", describeValue(args[1]))
+		}
+		places = math.Max(-maxRoundPlaces, math.Min(places, maxRoundPlaces))
+	}
+	if rs, ok, err := decimalArgs(args); ok {
+		if err != nil {
+			return nil, err
+		}
+		mode := &DecimalMode{Rounding: RoundHalfUp}
+		if places >= 0 {
+			mode.Scale = int(places)
+			return Decimal{mode.round(rs[0])}, nil
+		}
+		tens := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-places)), nil))
+		r := mode.round(new(big.Rat).Quo(rs[0], tens))
+		return Decimal{r.Mul(r, tens)}, nil
+	}
+	x, err := argFloat(args[0])
+	if err != nil {
+		return nil, err
+	}
+	scale := math.Pow(10, places)
+	if math.IsInf(x*scale, 0) {
+		// x has no digits that far down.
+		return x, nil
+	}
+	return math.Round(x*scale) / scale, nil
+}
+
+// now reads the system clock. Expressions evaluated by a network read the
+// clock set with SetClock instead.
+func now(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	return time.Now(), nil
+}
+
+func duration(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	d, ok := asDuration(args[0])
+	if !ok {
+		return nil, fmt.Errorf("%s is not a duration", describeValue(args[0]))
+	}
+	return d, nil
+}
+
+// parseTime accepts RFC 3339 times, and dates and times without a zone,
+// which are UTC.
+func parseTime(args ...interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	t, ok := asTime(args[0])
+	if !ok {
+		return nil, fmt.Errorf("%s is not a time", describeValue(args[0]))
+	}
+	return t, nil
+}
+
+// temporalOrder returns before when sign is -1 and after when it is 1.
+func temporalOrder(sign int) Function {
+	return func(args ...interface{}) (interface{}, error) {
+		if err := checkArgs(args, 2, 2); err != nil {
+			return nil, err
+		}
+		a, ok := asTime(args[0])
+		if !ok {
+			return nil, fmt.Errorf("%s is not a time", describeValue(args[0]))
+		}
+		b, ok := asTime(args[1])
+		if !ok {
+			return nil, fmt.Errorf("%s is not a time", describeValue(args[1]))
+		}
+		return a.Compare(b) == sign, nil
+	}
+}
@@ -6,6 +6,9 @@ type TestAtJoinNode struct {
 	fieldOfArg1           int
 	conditionNumberOfArg2 int
 	fieldOfArg2           int
+	// bindingOfArg2 names a computed binding, such as an accumulate result,
+	// compared instead of a field of an earlier WME
+	bindingOfArg2 string
 }
 
 type JoinNode struct {
@@ -63,16 +66,7 @@ func (node *JoinNode) LeftActivation(t *Token, w *WME, b Env) {
 	}
 }
 func (node *JoinNode) performJoinTests(t *Token, w *WME) bool {
-	for e := node.tests.Front(); e != nil; e = e.Next() {
-		test := e.Value.(*TestAtJoinNode)
-		arg1 := w.fields[test.fieldOfArg1]
-		wme2 := t.get_wmes()[test.conditionNumberOfArg2]
-		arg2 := wme2.fields[test.fieldOfArg2]
-		if arg1 != arg2 {
-			return false
-		}
-	}
-	return true
+	return performJoinTests(node.tests, t, w)
 }
 func (node *JoinNode) makeBinding(w *WME) Env {
 	b := make(Env)
@@ -83,3 +77,21 @@ func (node *JoinNode) makeBinding(w *WME) Env {
 	}
 	return b
 }
+
+func performJoinTests(tests *list.List, t *Token, w *WME) bool {
+	for e := tests.Front(); e != nil; e = e.Next() {
+		test := e.Value.(*TestAtJoinNode)
+		arg1 := w.fields[test.fieldOfArg1]
+		var arg2 string
+		if test.bindingOfArg2 != "" {
+			arg2 = bindingString(t.GetBinding(test.bindingOfArg2))
+		} else {
+			wme2 := t.get_wmes()[test.conditionNumberOfArg2]
+			arg2 = wme2.fields[test.fieldOfArg2]
+		}
+		if arg1 != arg2 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,183 @@
+package rete
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"time"
+)
+
+// ErrEvalLimit is wrapped by the errors of evaluations that go over the
+// limits of a network.
+var ErrEvalLimit = errors.New("evaluation limit exceeded")
+
+// EvalLimits bound the expressions of filters and binds. Zero values are no
+// limit.
+type EvalLimits struct {
+	// MaxDepth is the depth of the expression tree.
+	MaxDepth int
+	// MaxOperations counts the operators and calls of one evaluation.
+	MaxOperations int
+	// Timeout is checked between operations, and a function call is given up
+	// on when it does not return in time. Go cannot stop the call, so it runs
+	// on, and its result is dropped.
+	Timeout time.Duration
+	// AllowedFunctions, when not nil, names the only functions expressions
+	// may call, built-in or not.
+	AllowedFunctions []string
+}
+
+type evalLimits struct {
+	EvalLimits
+	allowed map[string]bool
+}
+
+// SetEvalLimits sets the limits of filters and binds. Productions added from
+// now on are checked against MaxDepth and AllowedFunctions; all evaluations
+// from now on are held to every limit, and fail as filter errors.
+func (n *Network) SetEvalLimits(limits EvalLimits) {
+	l := &evalLimits{EvalLimits: limits}
+	if limits.AllowedFunctions != nil {
+		l.allowed = make(map[string]bool)
+		for _, name := range limits.AllowedFunctions {
+			l.allowed[name] = true
+		}
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.evalOptions.limits = l
+}
+
+// step counts an operation.
+func (c *evalContext) step() error {
+	if c.limits == nil {
+		return nil
+	}
+	c.ops++
+	if c.limits.MaxOperations > 0 && c.ops > c.limits.MaxOperations {
+		return fmt.Errorf("%w: more than %d operations", ErrEvalLimit, c.limits.MaxOperations)
+	}
+	if c.limits.Timeout > 0 && time.Now().After(c.deadline) {
+		return fmt.Errorf("%w: over %s", ErrEvalLimit, c.limits.Timeout)
+	}
+	return nil
+}
+
+// call counts a call of the function name.
+func (c *evalContext) call(name string) error {
+	if c.limits != nil && c.limits.allowed != nil && !c.limits.allowed[name] {
+		return fmt.Errorf("function `%s` not allowed", name)
+	}
+	return c.step()
+}
+
+// invoke runs a call of the function name. Under a timeout, it runs f on its
+// own goroutine and stops waiting at the deadline; a panic of f is returned
+// as an error.
+func (c *evalContext) invoke(name string, f func() (interface{}, error)) (interface{}, error) {
+	if c.limits == nil || c.limits.Timeout <= 0 {
+		return f()
+	}
+	type result struct {
+		value interface{}
+		err   error
+		panic interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		defer func() {
+			if p := recover(); p != nil {
+				r.panic = p
+			}
+			done <- r
+		}()
+		r.value, r.err = f()
+	}()
+	timer := time.NewTimer(time.Until(c.deadline))
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if r.panic != nil {
+			return nil, fmt.Errorf("%s: panic: %v", name, r.panic)
+		}
+		return r.value, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: `%s` did not return within %s", ErrEvalLimit, name, c.limits.Timeout)
+	}
+}
+
+// checkLHS checks the expressions of lhs against the limits that can be told
+// before evaluation.
+func (limits *evalLimits) checkLHS(items []interface{}) error {
+	if limits == nil {
+		return nil
+	}
+	for _, item := range items {
+		var tmpl string
+		switch item := item.(type) {
+		case Filter:
+			tmpl = item.tmpl
+		case Bind:
+			tmpl = item.tmpl
+		case LHS:
+			if err := limits.checkLHS(item.items); err != nil {
+				return err
+			}
+		case Forall:
+			if err := limits.checkLHS(append([]interface{}{item.cond}, item.requirements...)); err != nil {
+				return err
+			}
+		}
+		if tmpl == "" {
+			continue
+		}
+		e, err := Compile(tmpl)
+		if err != nil {
+			return fmt.Errorf("expression `%s`: %w", tmpl, err)
+		}
+		if err := limits.check(e); err != nil {
+			return fmt.Errorf("expression `%s`: %w", tmpl, err)
+		}
+	}
+	return nil
+}
+
+func (limits *evalLimits) check(e *Expression) error {
+	if limits.MaxDepth > 0 && e.depth > limits.MaxDepth {
+		return fmt.Errorf("%w: depth %d over %d", ErrEvalLimit, e.depth, limits.MaxDepth)
+	}
+	if limits.allowed == nil {
+		return nil
+	}
+	var err error
+	ast.Inspect(e.ast, func(node ast.Node) bool {
+		if call, ok := node.(*ast.CallExpr); ok && err == nil {
+			fun, ok := call.Fun.(*ast.Ident)
+			if ok && (fun.Name == listFunction || fun.Name == inFunction) {
+				return true
+			}
+			if !ok || !limits.allowed[fun.Name] {
+				err = fmt.Errorf("function `%s` not allowed", call.Fun)
+			}
+		}
+		return err == nil
+	})
+	return err
+}
+
+func exprDepth(exp ast.Expr) int {
+	depth, max := 0, 0
+	ast.Inspect(exp, func(node ast.Node) bool {
+		if node == nil {
+			depth--
+			return false
+		}
+		depth++
+		if depth > max {
+			max = depth
+		}
+		return true
+	})
+	return max
+}
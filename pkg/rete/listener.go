@@ -0,0 +1,88 @@
+package rete
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Listener is told about the life of WMEs, activations and firings. The WME
+// and activation callbacks run while the network is changing, so they must
+// not change the network. Embed BaseListener to implement only some of them.
+type Listener interface {
+	WMEAsserted(w *WME)
+	// WMERetracted is not called for WMEs removed with the package-level
+	// RemoveWME.
+	WMERetracted(w *WME)
+	// ActivationCreated is called when a token enters the P-node of a
+	// production, and ActivationCancelled when it leaves as its match goes
+	// away. Firing does not remove it.
+	ActivationCreated(pNode *BetaMemory, token *Token)
+	ActivationCancelled(pNode *BetaMemory, token *Token)
+	BeforeFire(pNode *BetaMemory, token *Token)
+	// AfterFire gets the error the firing returned as a FiringError, if any.
+	AfterFire(pNode *BetaMemory, token *Token, err error, duration time.Duration)
+}
+
+// BaseListener ignores every event.
+type BaseListener struct{}
+
+func (BaseListener) WMEAsserted(*WME)                                    {}
+func (BaseListener) WMERetracted(*WME)                                   {}
+func (BaseListener) ActivationCreated(*BetaMemory, *Token)               {}
+func (BaseListener) ActivationCancelled(*BetaMemory, *Token)             {}
+func (BaseListener) BeforeFire(*BetaMemory, *Token)                      {}
+func (BaseListener) AfterFire(*BetaMemory, *Token, error, time.Duration) {}
+
+// listeners is shared by a network and its P-nodes. It is replaced, not
+// changed, so reading it is a single load.
+type listeners struct {
+	list atomic.Pointer[[]Listener]
+}
+
+// get returns the listeners, or nil when there are none.
+func (ls *listeners) get() []Listener {
+	if ls == nil {
+		return nil
+	}
+	if l := ls.list.Load(); l != nil {
+		return *l
+	}
+	return nil
+}
+
+// AddListener registers l; listeners are called in the order they are added.
+func (n *Network) AddListener(l Listener) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	list := append(append([]Listener{}, n.listeners.get()...), l)
+	n.listeners.list.Store(&list)
+}
+
+// RemoveListener unregisters l.
+func (n *Network) RemoveListener(l Listener) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var list []Listener
+	for _, x := range n.listeners.get() {
+		if x != l {
+			list = append(list, x)
+		}
+	}
+	if len(list) == 0 {
+		n.listeners.list.Store(nil)
+		return
+	}
+	n.listeners.list.Store(&list)
+}
+
+func (n *Network) wmeAsserted(w *WME) {
+	for _, l := range n.listeners.get() {
+		l.WMEAsserted(w)
+	}
+}
+
+func (n *Network) wmeRetracted(w *WME) {
+	for _, l := range n.listeners.get() {
+		l.WMERetracted(w)
+	}
+}
@@ -27,11 +27,10 @@ func (node *NccNode) LeftActivation(t *Token, w *WME, b Env) {
 
 	newToken.nccResults = list.New()
 	buffer := node.partner.newResultBuffer
-	for e := buffer.Front(); e != nil; e = e.Next() {
-		result := e.Value.(*Token)
+	for buffer.Len() > 0 {
+		result := buffer.Remove(buffer.Front()).(*Token)
 		result.owner = newToken
 		newToken.nccResults.PushBack(result)
-		buffer.Remove(e)
 	}
 	if newToken.nccResults.Len() > 0 {
 		return
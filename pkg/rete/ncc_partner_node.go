@@ -22,7 +22,7 @@ func (node NccPartnerNode) GetItems() *list.List {
 func (node NccPartnerNode) GetChildren() *list.List {
 	return node.children
 }
-func (node NccPartnerNode) LeftActivation(t *Token, w *WME, b Env) {
+func (node *NccPartnerNode) LeftActivation(t *Token, w *WME, b Env) {
 	nccNode := node.nccNode
 	newResult := makeToken(node, t, w, b)
 	ownersT := t
@@ -32,11 +32,11 @@ func (node NccPartnerNode) LeftActivation(t *Token, w *WME, b Env) {
 		ownersT = ownersT.parent
 	}
 	for e := nccNode.GetItems().Front(); e != nil; e = e.Next() {
-		item := e.Value.(*Token)
-		if item.parent == ownersT && item.wme == ownersW {
-			item.nccResults.PushBack(item)
-			newResult.owner = item
-			item.deleteTokenAndDescendents()
+		owner := e.Value.(*Token)
+		if owner.parent == ownersT && owner.wme == ownersW {
+			owner.nccResults.PushBack(newResult)
+			newResult.owner = owner
+			owner.deleteDescendents()
 			return
 		}
 	}
@@ -41,7 +41,6 @@ func (node *NegativeNode) LeftActivation(t *Token, w *WME, b Env) {
 				wme:   w,
 			}
 			newToken.joinResults.PushBack(jr)
-			w.negativeJoinResults = list.New()
 			w.negativeJoinResults.PushBack(jr)
 		}
 	}
@@ -57,27 +56,17 @@ func (node *NegativeNode) RightActivation(w *WME) {
 		t := e.Value.(*Token)
 		if node.perform_join_tests(t, w) {
 			if t.joinResults.Len() == 0 {
-				t.deleteTokenAndDescendents()
+				t.deleteDescendents()
 			}
 			jr := &NegativeJoinResult{
 				owner: t,
 				wme:   w,
 			}
 			t.joinResults.PushBack(jr)
-			w.negativeJoinResults = list.New()
 			w.negativeJoinResults.PushBack(jr)
 		}
 	}
 }
 func (node *NegativeNode) perform_join_tests(t *Token, w *WME) bool {
-	for e := node.tests.Front(); e != nil; e = e.Next() {
-		test := e.Value.(*TestAtJoinNode)
-		arg1 := w.fields[test.fieldOfArg1]
-		wme2 := t.get_wmes()[test.conditionNumberOfArg2]
-		arg2 := wme2.fields[test.fieldOfArg2]
-		if arg1 != arg2 {
-			return false
-		}
-	}
-	return true
+	return performJoinTests(node.tests, t, w)
 }
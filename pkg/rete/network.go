@@ -1,11 +1,15 @@
 package rete
 
 import (
-	"bytes"
 	"container/list"
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"rgehrsitz/rexrete/pkg/rules"
 	"runtime/debug"
+	"sync"
+	"time"
 )
 
 type IReteNode interface {
@@ -23,7 +27,31 @@ type Network struct {
 	objects   Env // for rhs result
 	PNodes    []*BetaMemory
 	halt      bool
-	LogBuf    *bytes.Buffer
+	// lock is held while the network changes, and while ExecuteRules collects
+	// the activations to fire
+	lock           *sync.RWMutex
+	productionKeys map[*BetaMemory]string
+	filterErrors   *filterErrors
+	evalOptions    *evalOptions
+	registry       *ActionRegistry
+	firingPolicy   FiringErrorPolicy
+	logger         *slog.Logger
+	sink           Sink
+	tms            *truthMaintenance
+	listeners      *listeners
+}
+
+// SwapReport lists the P-nodes of the productions a swap added, removed and
+// kept. Kept productions retain their tokens.
+type SwapReport struct {
+	Added   []*BetaMemory
+	Removed []*BetaMemory
+	Kept    []*BetaMemory
+}
+
+type activation struct {
+	pNode *BetaMemory
+	token *Token
 }
 
 func NewNetwork() *Network {
@@ -48,7 +76,14 @@ func NewNetwork() *Network {
 		objects:   make(Env),
 		PNodes:    []*BetaMemory{},
 		halt:      false,
-		LogBuf:    &bytes.Buffer{},
+		lock:      &sync.RWMutex{},
+
+		productionKeys: make(map[*BetaMemory]string),
+		filterErrors:   &filterErrors{},
+		evalOptions:    &evalOptions{},
+		logger:         discardLogger,
+		tms:            newTruthMaintenance(),
+		listeners:      &listeners{},
 	}
 }
 
@@ -64,52 +99,442 @@ func (n Network) GetObject(key string) interface{} {
 	return n.objects[key]
 }
 
+// SetClock sets the clock that now() reads in filters and binds. Expressions
+// read the system clock by default. Filters are evaluated when tokens arrive,
+// so existing matches are not revisited when the clock moves.
+func (n *Network) SetClock(clock func() time.Time) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.evalOptions.clock = clock
+}
+
+// SetDecimalMode makes filters and binds compute with exact decimals, or
+// with float64 again when mode is nil. It applies to tokens arriving from
+// now on.
+func (n *Network) SetDecimalMode(mode *DecimalMode) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.evalOptions.decimal = nil
+	if mode != nil {
+		m := *mode
+		n.evalOptions.decimal = &m
+	}
+}
+
 func (n *Network) Halt() {
 	n.halt = true
 }
 
-func (n *Network) ExecuteRules(env Env) (err error) {
-	for _, pNode := range n.PNodes {
-		for elem := pNode.GetItems().Front(); elem != nil; elem = elem.Next() {
-			token := elem.Value.(*Token)
-			if pNode.RHS == nil || len(pNode.RHS.tmpl) == 0 {
+// ExecuteRules is ExecuteRulesContext without a deadline, returning only
+// the error.
+func (n *Network) ExecuteRules(env Env) error {
+	_, err := n.ExecuteRulesContext(context.Background(), env)
+	return err
+}
+
+// RunReport tells how far a run of ExecuteRulesContext got.
+type RunReport struct {
+	// Fired counts the firings, failed ones included.
+	Fired int
+	// Failed counts the firings that returned a FiringError.
+	Failed int
+	// Pending counts the activations left unfired when the run stopped
+	// early.
+	Pending int
+}
+
+// ExecuteRulesContext fires activations until none is left that has not
+// fired during this call, so that activations created by firing, such as by
+// the actions of a JSON rhs, fire too. An activation runs its actions,
+// renders its template to the Sink, then runs the handler of its tmpl, from
+// the ActionRegistry or else from env, which gets ctx. Handlers run without
+// the network lock held, so they may change the network; activations they
+// retract are skipped.
+//
+// Failed firings are returned as FiringErrors, joined under ContinueOnError.
+// ctx is checked between firings; once it is done, the run stops with its
+// error. A filter error under FilterErrorHalt stops the run too.
+func (n *Network) ExecuteRulesContext(ctx context.Context, env Env) (RunReport, error) {
+	var report RunReport
+	if e := n.filterErrors.haltedBy(); e != nil {
+		return report, e
+	}
+	fired := make(map[*Token]bool)
+	var errs []error
+	stop := func(err error) (RunReport, error) {
+		report.Pending = n.pending(fired, env)
+		return report, errors.Join(append(errs, err)...)
+	}
+	for {
+		progress := false
+		for _, a := range n.activations() {
+			pNode, token := a.pNode, a.token
+			if fired[token] || pNode.RHS == nil {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return stop(err)
+			}
+			fired[token] = true
+			handler, err := n.handler(pNode.RHS.tmpl, env)
+			if handler == nil && err == nil && !pNode.RHS.declarative() {
 				continue
 			}
-			handler := env[pNode.RHS.tmpl]
-			if handler == nil {
+			n.lock.RLock()
+			deleted := token.deleted
+			n.lock.RUnlock()
+			if deleted {
 				continue
 			}
-			func() {
-				defer func() {
-					l := log.New(n.LogBuf, "RHS `"+pNode.RHS.tmpl+"` ", log.Lshortfile)
-					if e := recover(); e != nil {
-						l.Printf("%s %s", e, debug.Stack())
-					}
-
-				}()
-				handler.(func(network *Network, token *Token))(
-					n, token,
-				)
-			}()
+			progress = true
+			report.Fired++
+			ls := n.listeners.get()
+			var start time.Time
+			if ls != nil {
+				for _, l := range ls {
+					l.BeforeFire(pNode, token)
+				}
+				start = time.Now()
+			}
+			if err == nil {
+				err = n.fire(ctx, pNode, token, handler)
+			}
+			var fe error
+			if err != nil {
+				report.Failed++
+				fe = n.firingError(pNode, token, err)
+				errs = append(errs, fe)
+			}
+			if ls != nil {
+				d := time.Since(start)
+				for _, l := range ls {
+					l.AfterFire(pNode, token, fe, d)
+				}
+			}
+			n.lock.RLock()
+			policy := n.firingPolicy
+			n.lock.RUnlock()
+			if fe != nil && policy == StopOnError {
+				return stop(nil)
+			}
 			if n.halt {
-				return nil
+				return stop(nil)
 			}
+			if e := n.filterErrors.haltedBy(); e != nil {
+				return stop(e)
+			}
+		}
+		if !progress {
+			return report, errors.Join(errs...)
 		}
 	}
-	return nil
 }
 
-func (n *Network) AddProduction(lhs LHS, rhs RHS) *BetaMemory {
+// pending counts the activations not in fired that the run would fire with
+// the handlers of env.
+func (n *Network) pending(fired map[*Token]bool, env Env) int {
+	count := 0
+	for _, a := range n.activations() {
+		if fired[a.token] || a.pNode.RHS == nil {
+			continue
+		}
+		handler, err := n.handler(a.pNode.RHS.tmpl, env)
+		if handler != nil || err != nil || a.pNode.RHS.declarative() {
+			count++
+		}
+	}
+	return count
+}
+
+// fire runs the actions of pNode, renders its template, then runs handler,
+// turning a panic in any of them into a PanicError.
+func (n *Network) fire(ctx context.Context, pNode *BetaMemory, token *Token, handler ActionHandler) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = &PanicError{Value: e, Stack: debug.Stack()}
+		}
+	}()
+	if len(pNode.RHS.actions) > 0 {
+		if err := n.fireActions(pNode.RHS, token); err != nil {
+			return err
+		}
+	}
+	if pNode.RHS.template != nil {
+		if err := n.render(ctx, pNode, token); err != nil {
+			return err
+		}
+	}
+	if handler == nil {
+		return nil
+	}
+	// settle what the handler changed with the package-level RemoveWME
+	defer func() {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		n.settle()
+	}()
+	return handler(ctx, n, token)
+}
+
+// handler finds the handler of tmpl in the registry, then in env, where it
+// may also be a func(*Network, *Token).
+func (n *Network) handler(tmpl string, env Env) (ActionHandler, error) {
+	if tmpl == "" {
+		return nil, nil
+	}
+	if n.registry != nil {
+		if h, ok := n.registry.Lookup(tmpl); ok {
+			return h, nil
+		}
+	}
+	switch h := env[tmpl].(type) {
+	case nil:
+		return nil, nil
+	case ActionHandler:
+		return h, nil
+	case func(context.Context, *Network, *Token) error:
+		return h, nil
+	case func(*Network, *Token):
+		return func(_ context.Context, network *Network, token *Token) error {
+			h(network, token)
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("handler `%s` is a %T", tmpl, h)
+	}
+}
+
+func (n *Network) activations() []activation {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	var ret []activation
+	for _, pNode := range n.PNodes {
+		for elem := pNode.GetItems().Front(); elem != nil; elem = elem.Next() {
+			ret = append(ret, activation{pNode, elem.Value.(*Token)})
+		}
+	}
+	return ret
+}
+
+// AddProduction adds a production and seeds it from working memory. Nothing
+// is built if the production does not pass checkProduction.
+func (n *Network) AddProduction(lhs LHS, rhs RHS) (*BetaMemory, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err := n.checkProduction(lhs, &rhs); err != nil {
+		return nil, err
+	}
+	return n.addProduction(lhs, rhs), nil
+}
+
+// checkProduction checks a production before it is added: the LHS against
+// the functions of the network and its limits, the template against the
+// LHS, and the handler against the registry. The caller holds n.lock.
+func (n *Network) checkProduction(lhs LHS, rhs *RHS) error {
+	if err := validateLHS(lhs, n.evalOptions.isFunction); err != nil {
+		return err
+	}
+	if err := rhs.checkTemplate(lhs); err != nil {
+		return err
+	}
+	if err := n.evalOptions.limits.checkLHS(lhs.items); err != nil {
+		return err
+	}
+	return n.registry.check(rhs)
+}
+
+func (n *Network) addProduction(lhs LHS, rhs RHS) *BetaMemory {
 	currentNode := n.buildOrShareNetworkForConditions(n.betaRoot, lhs, LHS{})
 	node := n.buildOrShareBetaMemory(currentNode)
 	memory := node.(*BetaMemory)
 	memory.RHS = &rhs
+	if memory.listeners == nil {
+		memory.listeners = n.listeners
+		for e := memory.items.Front(); e != nil; e = e.Next() {
+			for _, l := range n.listeners.get() {
+				l.ActivationCreated(memory, e.Value.(*Token))
+			}
+		}
+	}
 	n.PNodes = append(n.PNodes, memory)
+	n.productionKeys[memory] = NewProduction(lhs, rhs).key()
 	return memory
 }
 
+// ReplaceProductions swaps the productions of the network for ps while
+// keeping working memory. Productions already present are kept with their
+// tokens, the others are removed, and new ones are seeded from working
+// memory. Concurrent callers see either the old or the new set. Nothing
+// changes if a production does not pass checkProduction.
+func (n *Network) ReplaceProductions(ps []Production) (SwapReport, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, p := range ps {
+		if err := n.checkProduction(p.lhs, &p.rhs); err != nil {
+			return SwapReport{}, err
+		}
+	}
+	var report SwapReport
+	current := make(map[string][]*BetaMemory)
+	for _, pNode := range n.PNodes {
+		key := n.productionKeys[pNode]
+		current[key] = append(current[key], pNode)
+	}
+	pNodes := make([]*BetaMemory, len(ps))
+	for i, p := range ps {
+		key := p.key()
+		if kept := current[key]; len(kept) > 0 {
+			current[key] = kept[1:]
+			pNodes[i] = kept[0]
+			report.Kept = append(report.Kept, kept[0])
+		}
+	}
+	// build new productions before tearing down old ones, so that alpha
+	// memories they share are not deleted and seeded again
+	for i, p := range ps {
+		if pNodes[i] == nil {
+			pNodes[i] = n.addProduction(p.lhs, p.rhs)
+			report.Added = append(report.Added, pNodes[i])
+		}
+	}
+	for _, pNode := range n.PNodes {
+		key := n.productionKeys[pNode]
+		if removed := current[key]; len(removed) > 0 && removed[0] == pNode {
+			current[key] = removed[1:]
+			report.Removed = append(report.Removed, pNode)
+		}
+	}
+	for _, pNode := range report.Removed {
+		n.removeProduction(pNode)
+	}
+	n.PNodes = pNodes
+	return report, nil
+}
+
+// ReplaceRules is ReplaceProductions for the productions compiled from rs.
+// Nothing changes if a rule cannot be compiled.
+func (n *Network) ReplaceRules(rs []rules.Rule) (SwapReport, error) {
+	var ps []Production
+	for _, rule := range rs {
+		rulePs, err := ProductionsFromRule(rule)
+		if err != nil {
+			return SwapReport{}, err
+		}
+		ps = append(ps, rulePs...)
+	}
+	return n.ReplaceProductions(ps)
+}
+
+// RemoveProduction removes a production added with AddProduction. Its tokens
+// are deleted along with every node and alpha memory no other production uses.
+func (n *Network) RemoveProduction(pNode *BetaMemory) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.removeProduction(pNode)
+}
+
+func (n *Network) removeProduction(pNode *BetaMemory) error {
+	idx := -1
+	for i, p := range n.PNodes {
+		if p == pNode {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return errors.New("production not in network")
+	}
+	n.PNodes = append(n.PNodes[:idx], n.PNodes[idx+1:]...)
+	for _, p := range n.PNodes {
+		if p == pNode {
+			return nil
+		}
+	}
+	delete(n.productionKeys, pNode)
+	defer n.settle()
+	if pNode.children.Len() > 0 {
+		// the memory is shared with productions built below it, so its
+		// tokens stay but no longer support what the production asserted
+		for e := pNode.items.Front(); e != nil; e = e.Next() {
+			tok := e.Value.(*Token)
+			if tok.onDelete != nil {
+				n.tms.unsupport(tok)
+				tok.onDelete = nil
+			}
+		}
+		pNode.RHS = nil
+		pNode.listeners = nil
+		return nil
+	}
+	n.deleteNodeAndAnyUnusedAncestors(pNode)
+	return nil
+}
+
+func (n *Network) deleteNodeAndAnyUnusedAncestors(node IReteNode) {
+	if items := node.GetItems(); items != nil {
+		for items.Len() > 0 {
+			items.Front().Value.(*Token).deleteTokenAndDescendents()
+		}
+	}
+	var amem *AlphaMemory
+	switch node := node.(type) {
+	case *NccNode:
+		// owners are gone, so the subnetwork no longer reactivates anything
+		n.deleteNodeAndAnyUnusedAncestors(node.partner)
+	case *NccPartnerNode:
+		for node.newResultBuffer.Len() > 0 {
+			node.newResultBuffer.Front().Value.(*Token).deleteTokenAndDescendents()
+		}
+	case *JoinNode:
+		amem = node.amem
+	case *NegativeNode:
+		amem = node.amem
+	case *ExistsNode:
+		amem = node.amem
+	case *AccumulateNode:
+		amem = node.amem
+	}
+	if amem != nil {
+		removeByValue(amem.successors, node)
+		if amem.successors.Len() == 0 {
+			n.deleteAlphaMemory(amem)
+		}
+	}
+	parent := node.GetParent()
+	removeByValue(parent.GetChildren(), node)
+	if parent != n.betaRoot && parent.GetChildren().Len() == 0 {
+		n.deleteNodeAndAnyUnusedAncestors(parent)
+	}
+}
+
+func (n *Network) deleteAlphaMemory(amem *AlphaMemory) {
+	// the working memory at the root is never deleted
+	if amem == n.alphaRoot.outputMemory {
+		return
+	}
+	for amem.items.Len() > 0 {
+		w := amem.items.Remove(amem.items.Front()).(*WME)
+		removeByValue(w.alphaMems, amem)
+	}
+	n.alphaRoot.prune(amem)
+}
+
 func (n *Network) AddWME(w *WME) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.wmeAsserted(w)
 	n.alphaRoot.activation(w)
+	n.settle()
+}
+
+// RemoveWME is RemoveWME holding the network lock and telling listeners,
+// then retracting the logical assertions left without support. A WME not in
+// working memory is left alone.
+func (n *Network) RemoveWME(w *WME) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.retract(w)
+	n.settle()
 }
 
 func (n Network) buildOrShareNetworkForConditions(
@@ -129,12 +554,29 @@ func (n Network) buildOrShareNetworkForConditions(
 				am := n.buildOrShareAlphaMemory(cond)
 				currentNode = n.buildOrShareNegativeNode(currentNode, am, tests)
 			}
+		case Exists:
+			tests := n.getJoinTestsFromCondition(cond.Has, condsHigherUp)
+			am := n.buildOrShareAlphaMemory(cond.Has)
+			currentNode = n.buildOrShareExistsNode(currentNode, am, tests)
+		case Accumulate:
+			tests := n.getJoinTestsFromCondition(cond.Has, condsHigherUp)
+			am := n.buildOrShareAlphaMemory(cond.Has)
+			currentNode = n.buildOrShareAccumulateNode(currentNode, am, tests, &cond)
+		case Collect:
+			acc := cond.accumulate()
+			tests := n.getJoinTestsFromCondition(cond.Has, condsHigherUp)
+			am := n.buildOrShareAlphaMemory(cond.Has)
+			currentNode = n.buildOrShareAccumulateNode(currentNode, am, tests, &acc)
 		case Filter:
 			currentNode = n.buildOrShareFilterNode(currentNode, cond)
+		case Bind:
+			currentNode = n.buildOrShareBindNode(currentNode, cond)
 		case LHS:
 			if cond.negative {
 				currentNode = n.buildOrShareNccNodes(currentNode, cond, condsHigherUp)
 			}
+		case Forall:
+			currentNode = n.buildOrShareNccNodes(currentNode, cond.ncc(), condsHigherUp)
 		}
 		condsHigherUp.items = append(condsHigherUp.items, cond)
 	}
@@ -152,15 +594,51 @@ func (n Network) buildOrShareFilterNode(parent IReteNode, f Filter) IReteNode {
 			}
 		}
 	}
+	// validateLHS compiled the expression before any node was built
+	expr, err := Compile(f.tmpl)
+	if err != nil {
+		panic(fmt.Sprintf("filter `%s` not validated: %v", f.tmpl, err))
+	}
 	filter_node := &FilterNode{
 		parent:   parent,
 		children: list.New(),
 		tmpl:     f.tmpl,
+		expr:     expr,
+		errors:   n.filterErrors,
+		options:  n.evalOptions,
 	}
 	parent.GetChildren().PushBack(filter_node)
 	return filter_node
 }
 
+func (n Network) buildOrShareBindNode(parent IReteNode, b Bind) IReteNode {
+	for e := parent.GetChildren().Front(); e != nil; e = e.Next() {
+		child := e.Value.(IReteNode)
+		if child.GetNodeType() == BindNodeTy {
+			child := child.(*BindNode)
+			if child.variable == b.variable && child.tmpl == b.tmpl {
+				return child
+			}
+		}
+	}
+	// validateLHS compiled the expression before any node was built
+	expr, err := Compile(b.tmpl)
+	if err != nil {
+		panic(fmt.Sprintf("bind `%s` not validated: %v", b.tmpl, err))
+	}
+	bindNode := &BindNode{
+		parent:   parent,
+		children: list.New(),
+		variable: b.variable,
+		tmpl:     b.tmpl,
+		expr:     expr,
+		errors:   n.filterErrors,
+		options:  n.evalOptions,
+	}
+	parent.GetChildren().PushBack(bindNode)
+	return bindNode
+}
+
 func (n Network) buildOrShareNccNodes(parent IReteNode, ncc LHS, earlier LHS) IReteNode {
 	bottomOfSubnetwork := n.buildOrShareNetworkForConditions(parent, ncc, earlier)
 	for e := parent.GetChildren().Front(); e != nil; e = e.Next() {
@@ -172,6 +650,14 @@ func (n Network) buildOrShareNccNodes(parent IReteNode, ncc LHS, earlier LHS) IR
 			}
 		}
 	}
+	// filters and binds do not add a token, so the partner does not walk
+	// past them
+	numberOfConjuncts := 0
+	for _, cond := range ncc.items {
+		if addsToken(cond) {
+			numberOfConjuncts++
+		}
+	}
 	nccNode := &NccNode{
 		parent:   parent,
 		children: list.New(),
@@ -181,7 +667,7 @@ func (n Network) buildOrShareNccNodes(parent IReteNode, ncc LHS, earlier LHS) IR
 		parent:            bottomOfSubnetwork,
 		children:          list.New(),
 		newResultBuffer:   list.New(),
-		numberOfConjuncts: len(ncc.items),
+		numberOfConjuncts: numberOfConjuncts,
 		nccNode:           nccNode,
 	}
 	nccNode.partner = nccPartnerNode
@@ -227,7 +713,9 @@ func (n Network) buildOrShareJoinNode(
 		has:      h,
 	}
 	parent.GetChildren().PushBack(node)
-	amem.successors.PushBack(node)
+	// descendents must be right-activated before their ancestors, otherwise a
+	// WME matching two conditions that share an alpha memory is joined twice
+	amem.successors.PushFront(node)
 	return node
 }
 
@@ -249,7 +737,56 @@ func (n Network) buildOrShareNegativeNode(parent IReteNode, amem *AlphaMemory, t
 		items:    list.New(),
 	}
 	parent.GetChildren().PushBack(node)
-	amem.successors.PushBack(node)
+	amem.successors.PushFront(node)
+	n.updateNewNodeWithMatchesAbove(node)
+	return node
+}
+
+func (n Network) buildOrShareExistsNode(parent IReteNode, amem *AlphaMemory, tests *list.List) IReteNode {
+	for e := parent.GetChildren().Front(); e != nil; e = e.Next() {
+		if e.Value.(IReteNode).GetNodeType() != ExistsNodeTy {
+			continue
+		}
+		node := e.Value.(*ExistsNode)
+		if node.amem == amem && node.tests == tests {
+			return node
+		}
+	}
+	node := &ExistsNode{
+		parent:   parent,
+		children: list.New(),
+		amem:     amem,
+		tests:    tests,
+		items:    list.New(),
+	}
+	parent.GetChildren().PushBack(node)
+	amem.successors.PushFront(node)
+	n.updateNewNodeWithMatchesAbove(node)
+	return node
+}
+
+func (n Network) buildOrShareAccumulateNode(
+	parent IReteNode, amem *AlphaMemory, tests *list.List, acc *Accumulate) IReteNode {
+	for e := parent.GetChildren().Front(); e != nil; e = e.Next() {
+		if e.Value.(IReteNode).GetNodeType() != AccumulateNodeTy {
+			continue
+		}
+		node := e.Value.(*AccumulateNode)
+		if node.amem == amem && node.tests == tests {
+			return node
+		}
+	}
+	node := &AccumulateNode{
+		parent:   parent,
+		children: list.New(),
+		amem:     amem,
+		tests:    tests,
+		items:    list.New(),
+		acc:      acc,
+		options:  n.evalOptions,
+	}
+	parent.GetChildren().PushBack(node)
+	amem.successors.PushFront(node)
 	n.updateNewNodeWithMatchesAbove(node)
 	return node
 }
@@ -302,15 +839,35 @@ func (n Network) getJoinTestsFromCondition(c Has, earlierConds LHS) *list.List {
 		if !isVar(v) {
 			continue
 		}
-		for condIdx, cond := range earlierConds.items {
+		// filters and binds pass tokens through without adding one, so the
+		// position of a condition in the token chain skips them
+		tokenIdx := 0
+		for _, cond := range earlierConds.items {
 			switch cond := cond.(type) {
 			case Has:
 				vField2 := cond.contain(v)
-				if vField2 == -1 || cond.negative {
-					continue
+				if vField2 != -1 && !cond.negative {
+					node := &TestAtJoinNode{vField1, tokenIdx, vField2, ""}
+					ret.PushBack(node)
+				}
+			case Accumulate:
+				if cond.result == v {
+					node := &TestAtJoinNode{vField1, tokenIdx, 0, varKey(v)}
+					ret.PushBack(node)
+				}
+			case Collect:
+				if cond.result == v {
+					node := &TestAtJoinNode{vField1, tokenIdx, 0, varKey(v)}
+					ret.PushBack(node)
+				}
+			case Bind:
+				if cond.variable == v {
+					node := &TestAtJoinNode{vField1, tokenIdx, 0, varKey(v)}
+					ret.PushBack(node)
 				}
-				node := &TestAtJoinNode{vField1, condIdx, vField2}
-				ret.PushBack(node)
+			}
+			if addsToken(cond) {
+				tokenIdx++
 			}
 		}
 	}
@@ -342,111 +899,66 @@ func (n Network) updateNewNodeWithMatchesAbove(node IReteNode) {
 	case NegativeNodeTy:
 		for e := parent.GetItems().Front(); e != nil; e = e.Next() {
 			t := e.Value.(*Token)
-			node.LeftActivation(t, nil, nil)
+			if t.joinResults.Len() == 0 {
+				node.LeftActivation(t, nil, nil)
+			}
 		}
-	case NccNodeTy:
+	case ExistsNodeTy:
 		for e := parent.GetItems().Front(); e != nil; e = e.Next() {
 			t := e.Value.(*Token)
-			node.LeftActivation(t, nil, nil)
-		}
-	}
-}
-
-func (n *Network) LoadRuleFromObject(rule rules.Rule) error {
-	// Step 1: Handle 'all' conditions - these will be processed as a series of AND-linked conditions
-	for _, cond := range rule.Conditions.All {
-		if err := n.addCondition(cond, true); err != nil {
-			return err // Handle or propagate error
-		}
-	}
-
-	// Step 2: Handle 'any' conditions - these may require more complex handling to represent OR logic
-	if len(rule.Conditions.Any) > 0 {
-		if err := n.addAnyConditions(rule.Conditions.Any); err != nil {
-			return err // Handle or propagate error
+			if t.joinResults.Len() > 0 {
+				node.LeftActivation(t, nil, nil)
+			}
 		}
-	}
-
-	// Step 3: Handle the rule's action/event part
-	// This will likely involve setting up a way to trigger the defined event when conditions are met
-	// Placeholder for now
-
-	return nil
-}
-
-func (n *Network) addCondition(cond rules.Condition, isAll bool) error {
-	// Find or create a ConstantTestNode for the condition
-	var testNode *ConstantTestNode
-	var exists bool
-
-	// Scan existing ConstantTestNodes for a match
-	// This is a simplification. In practice, you may need a more sophisticated way to manage and search nodes.
-	for e := n.alphaRoot.children.Front(); e != nil && !exists; e = e.Next() {
-		node := e.Value.(*ConstantTestNode)
-		if node.fieldToTest == mapConditionToFieldIndex(cond.Fact) && node.fieldMustEqual == cond.Value {
-			testNode = node
-			exists = true
+	case AccumulateNodeTy:
+		parent := parent.(*AccumulateNode)
+		for e := parent.GetItems().Front(); e != nil; e = e.Next() {
+			t := e.Value.(*Token)
+			if b, ok := parent.binding(t); ok {
+				node.LeftActivation(t, nil, b)
+			}
 		}
-	}
-
-	if !exists {
-		// Create a new ConstantTestNode if not found
-		testNode = &ConstantTestNode{
-			fieldToTest:    mapConditionToFieldIndex(cond.Fact),
-			fieldMustEqual: cond.Value.(string), // Assuming Value is always a string for simplification
-			outputMemory:   &AlphaMemory{items: list.New(), successors: list.New()},
-			children:       list.New(),
+	case FilterNodeTy:
+		parent := parent.(*FilterNode)
+		savedChildren := parent.children
+		hackChildren := list.New()
+		hackChildren.PushBack(node)
+		parent.children = hackChildren
+		n.updateNewNodeWithMatchesAbove(parent)
+		parent.children = savedChildren
+	case BindNodeTy:
+		parent := parent.(*BindNode)
+		savedChildren := parent.children
+		hackChildren := list.New()
+		hackChildren.PushBack(node)
+		parent.children = hackChildren
+		n.updateNewNodeWithMatchesAbove(parent)
+		parent.children = savedChildren
+	case NccNodeTy:
+		for e := parent.GetItems().Front(); e != nil; e = e.Next() {
+			t := e.Value.(*Token)
+			if t.nccResults.Len() == 0 {
+				node.LeftActivation(t, nil, nil)
+			}
 		}
-		n.alphaRoot.children.PushBack(testNode) // Attach new node to alphaRoot for now
 	}
-
-	// For 'all' conditions, you may need to further process or link this node within the network
-	// For example, linking ConstantTestNodes to a BetaNode if representing complex conditions
-	// This part of logic needs further development based on your specific network structure and rule logic
-
-	return nil
 }
 
-func (n *Network) addAnyConditions(conds []Condition) error {
-	orNode := NewOrNode() // Create a new OrNode to aggregate 'any' conditions
-
-	for _, cond := range conds {
-		testNode, err := n.createTestNodeFromCondition(cond) // Reuse logic to create/find ConstantTestNodes
-		if err != nil {
+// LoadRuleFromObject adds the productions compiled from rule.
+func (n *Network) LoadRuleFromObject(rule rules.Rule) error {
+	ps, err := ProductionsFromRule(rule)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, p := range ps {
+		if err := n.checkProduction(p.lhs, &p.rhs); err != nil {
 			return err
 		}
-		orNode.children = append(orNode.children, testNode)
-		// Link testNode to orNode here if necessary; this might require adjusting your model
 	}
-
-	// After all conditions are added, setup a mechanism to check activation
-	// This could be part of the network's evaluation cycle, where OrNodes are checked for any activated children
-	// Placeholder: Add orNode to a collection for evaluation or further processing
-
-	return nil
-}
-
-func (n *Network) createTestNodeFromCondition(cond Condition) (*ConstantTestNode, error) {
-	// Similar logic to addCondition, but return the created/found ConstantTestNode
-	// This function should encapsulate the creation and retrieval logic to avoid duplication
-}
-
-type OrNode struct {
-	children  []*ConstantTestNode
-	activated bool
-}
-
-func NewOrNode() *OrNode {
-	return &OrNode{children: make([]*ConstantTestNode, 0), activated: false}
-}
-
-// Activation logic for OrNode: Activates if any child node is activated.
-func (on *OrNode) activateIfAny() {
-	for _, child := range on.children {
-		// Assuming there's a way to check if a child node is activated; this might involve extending ConstantTestNode
-		if child.IsActivated() { // IsActivated is a hypothetical method; implementation depends on your system's specifics
-			on.activated = true
-			break
-		}
+	for _, p := range ps {
+		n.addProduction(p.lhs, p.rhs)
 	}
+	return nil
 }
@@ -1,10 +1,27 @@
 package rete
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"rgehrsitz/rexrete/pkg/rules"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
+func mustAddProduction(t *testing.T, n *Network, lhs LHS, rhs RHS) *BetaMemory {
+	t.Helper()
+	p, err := n.AddProduction(lhs, rhs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
 func TestNetworkAddWME(t *testing.T) {
 	n := NewNetwork()
 	c0 := NewHas("Object", "$x", "on", "$y")
@@ -42,7 +59,7 @@ func TestCase0(t *testing.T) {
 	c2 := NewHas("Object", "$z", "color", "red")
 	m := make(map[string]interface{})
 	m["dummy"] = 1
-	n.AddProduction(NewLHS(c0, c1, c2), RHS{
+	mustAddProduction(t, n, NewLHS(c0, c1, c2), RHS{
 		tmpl:  `F`,
 		Extra: m,
 	})
@@ -66,7 +83,6 @@ func TestCase0(t *testing.T) {
 	}
 	if n.GetObject("result") != "B1, B2, B3, 1" {
 		t.Error(n.GetObject("result"))
-		fmt.Print(n.LogBuf)
 	}
 
 }
@@ -75,7 +91,7 @@ func TestNegativeNode(t *testing.T) {
 	n := NewNetwork()
 	c0 := NewHas("Object", "$x", "on", "$y")
 	c1 := NewNeg("Object", "$y", "color", "blue")
-	p := n.AddProduction(NewLHS(c0, c1), NewRHS())
+	p := mustAddProduction(t, n, NewLHS(c0, c1), NewRHS())
 
 	wmes := []*WME{
 		NewWME("Object", "B1", "on", "B2"),
@@ -106,7 +122,7 @@ func TestNccNode(t *testing.T) {
 	c1 := NewHas("Object", "$y", "left_of", "$z")
 	c2 := NewHas("Object", "$z", "color", "red")
 	c3 := NewHas("Object", "$z", "on", "$w")
-	p := n.AddProduction(NewLHS(c0, c1, NewNccRule(c2, c3)), NewRHS())
+	p := mustAddProduction(t, n, NewLHS(c0, c1, NewNccRule(c2, c3)), NewRHS())
 	wmes := []*WME{
 		NewWME("Object", "B1", "on", "B2"),
 		NewWME("Object", "B1", "on", "B3"),
@@ -175,3 +191,1170 @@ func TestFromJSON(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestActions(t *testing.T) {
+	ps, err := FromJSON(`{"productions": [
+		{"lhs": [
+			{"tag": "has", "classname": "Order", "identifier": "$id", "attribute": "total", "value": "$t"},
+			{"tag": "filter", "tmpl": "$t > 100"}
+		], "rhs": {"assert": {"classname": "Order", "identifier": "$id", "attribute": "size", "value": "big"}}},
+		{"lhs": [
+			{"tag": "has", "classname": "Order", "identifier": "$id", "attribute": "size", "value": "big", "as": "$w"}
+		], "rhs": {"retract": "$w", "assert": [{"classname": "Discount", "identifier": "$id", "attribute": "rate", "value": "10"}]}},
+		{"lhs": [
+			{"tag": "has", "classname": "Order", "identifier": "$id", "attribute": "total", "value": "$t"},
+			{"tag": "has", "classname": "Order", "identifier": "$id", "attribute": "status", "value": "new", "as": "$s"}
+		], "rhs": {"modify": {"wme": "$s", "value": "open"}, "retract": {"classname": "Cart", "identifier": "$id", "attribute": "total", "value": "$t"}}}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNetwork()
+	if _, err := n.ReplaceProductions(ps); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []*WME{
+		NewWME("Order", "O1", "total", "150"),
+		NewWME("Order", "O1", "status", "new"),
+		NewWME("Cart", "O1", "total", "150"),
+		NewWME("Order", "O2", "total", "50"),
+	} {
+		n.AddWME(w)
+	}
+	if err := n.ExecuteRules(Env{}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, w := range n.workingMemory() {
+		got = append(got, w.String())
+	}
+	sort.Strings(got)
+	want := []string{"[Discount O1 rate 10]", "[Order O1 status open]", "[Order O1 total 150]", "[Order O2 total 50]"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	for _, rhs := range []string{
+		`{"retract": "$nope"}`,
+		`{"retract": "w"}`,
+		`{"assert": {"classname": "A", "identifier": "$x", "attribute": "b"}}`,
+		`{"assert": {"classname": "A", "identifier": "$y", "attribute": "b", "value": "c"}}`,
+		`{"modify": {"value": "c"}}`,
+	} {
+		_, err := FromJSON(`{"productions": [{"rhs": ` + rhs + `, "lhs": [
+			{"tag": "has", "classname": "A", "identifier": "$x", "attribute": "b", "value": "c", "as": "$w"}]}]}`)
+		if err == nil {
+			t.Errorf("%s: expected error", rhs)
+		}
+	}
+	_, err = FromJSON(`{"productions": [{"rhs": {}, "lhs": [
+		{"tag": "has", "classname": "A", "identifier": "$x", "attribute": "b", "value": "c"},
+		{"tag": "filter", "tmpl": "$x != 1", "as": "$w"}]}]}`)
+	if err == nil {
+		t.Error("expected error for as on a filter")
+	}
+
+	ps, err = FromJSON(`{"productions": [{"lhs": [
+		{"tag": "has", "classname": "A", "identifier": "$x", "attribute": "b", "value": "c", "as": "$w"}
+	], "rhs": {"retract": "$w", "modify": {"wme": "$w", "value": "d"}}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n = NewNetwork()
+	if _, err := n.ReplaceProductions(ps); err != nil {
+		t.Fatal(err)
+	}
+	n.AddWME(NewWME("A", "A1", "b", "c"))
+	if err := n.ExecuteRules(Env{}); err != nil {
+		t.Fatal(err)
+	}
+	if wm := n.workingMemory(); len(wm) != 0 {
+		t.Errorf("expected the modify of a retracted WME to be skipped, got %v", wm)
+	}
+}
+
+func TestNccRetraction(t *testing.T) {
+	tokens := func(p *BetaMemory) []string {
+		var ret []string
+		for e := p.GetItems().Front(); e != nil; e = e.Next() {
+			ret = append(ret, fmt.Sprint(e.Value.(*Token)))
+		}
+		return ret
+	}
+	lhs := NewLHS(
+		NewHas("Object", "$x", "on", "$y"),
+		NewNccRule(
+			NewHas("Object", "$y", "color", "red"),
+			NewHas("Object", "$y", "left_of", "$z"),
+		),
+	)
+	on := NewWME("Object", "B1", "on", "B2")
+	red := NewWME("Object", "B2", "color", "red")
+	leftOf := NewWME("Object", "B2", "left_of", "B3")
+	unblocked := "<Token [Object B1 on B2], <nil>>"
+
+	// outer match first, then the subnetwork match arrives and goes away
+	n := NewNetwork()
+	p := mustAddProduction(t, n, lhs, NewRHS())
+	n.AddWME(on)
+	n.AddWME(red)
+	if got := tokens(p); len(got) != 1 || got[0] != unblocked {
+		t.Fatalf("expected unblocked token, got %v", got)
+	}
+	n.AddWME(leftOf)
+	if got := tokens(p); len(got) != 0 {
+		t.Fatalf("expected blocked, got %v", got)
+	}
+	RemoveWME(red)
+	if got := tokens(p); len(got) != 1 || got[0] != unblocked {
+		t.Fatalf("expected token after retracting support, got %v", got)
+	}
+	n.AddWME(red)
+	if got := tokens(p); len(got) != 0 {
+		t.Fatalf("expected blocked again, got %v", got)
+	}
+
+	// subnetwork match first, then the outer match
+	red = NewWME("Object", "B2", "color", "red")
+	leftOf = NewWME("Object", "B2", "left_of", "B3")
+	on = NewWME("Object", "B1", "on", "B2")
+	n = NewNetwork()
+	n.AddWME(red)
+	n.AddWME(leftOf)
+	p = mustAddProduction(t, n, lhs, NewRHS())
+	n.AddWME(on)
+	if got := tokens(p); len(got) != 0 {
+		t.Fatalf("expected blocked, got %v", got)
+	}
+	RemoveWME(leftOf)
+	if got := tokens(p); len(got) != 1 || got[0] != unblocked {
+		t.Fatalf("expected token after retracting support, got %v", got)
+	}
+	RemoveWME(on)
+	if got := tokens(p); len(got) != 0 {
+		t.Fatalf("expected no token after retracting owner, got %v", got)
+	}
+	if red.tokens.Len() != 0 {
+		t.Fatalf("subnetwork tokens left behind: %d", red.tokens.Len())
+	}
+}
+
+func TestExistsNode(t *testing.T) {
+	n := NewNetwork()
+	lhs, err := JSONParseLHS([]interface{}{
+		map[string]interface{}{
+			"tag": "has", "classname": "User", "identifier": "$u", "attribute": "tier", "value": "gold",
+		},
+		map[string]interface{}{
+			"tag": "exists", "classname": "Order", "identifier": "$o", "attribute": "user", "value": "$u",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := mustAddProduction(t, n, lhs, NewRHS())
+	n.AddWME(NewWME("User", "U1", "tier", "gold"))
+	if p.GetItems().Len() != 0 {
+		t.Fatalf("expected no match without orders, got %d", p.GetItems().Len())
+	}
+	o1 := NewWME("Order", "O1", "user", "U1")
+	o2 := NewWME("Order", "O2", "user", "U1")
+	n.AddWME(o1)
+	n.AddWME(o2)
+	n.AddWME(NewWME("Order", "O3", "user", "U2"))
+	if p.GetItems().Len() != 1 {
+		t.Fatalf("expected one match for two orders, got %d", p.GetItems().Len())
+	}
+	tok := p.GetItems().Front().Value.(*Token)
+	if tok.GetBinding("u") != "U1" || tok.GetBinding("o") != nil {
+		t.Errorf("unexpected bindings %v", tok.AllBinding())
+	}
+	RemoveWME(o1)
+	if p.GetItems().Len() != 1 {
+		t.Fatalf("expected match to survive while an order exists, got %d", p.GetItems().Len())
+	}
+	RemoveWME(o2)
+	if p.GetItems().Len() != 0 {
+		t.Fatalf("expected match retracted with the last order, got %d", p.GetItems().Len())
+	}
+}
+
+func TestForall(t *testing.T) {
+	n := NewNetwork()
+	lhs, err := JSONParseLHS([]interface{}{
+		map[string]interface{}{
+			"tag": "has", "classname": "Order", "identifier": "$o", "attribute": "status", "value": "open",
+		},
+		map[string]interface{}{
+			"tag": "forall",
+			"items": []interface{}{
+				map[string]interface{}{
+					"tag": "has", "classname": "LineItem", "identifier": "$li", "attribute": "order", "value": "$o",
+				},
+				map[string]interface{}{
+					"tag": "has", "classname": "LineItem", "identifier": "$li", "attribute": "stock", "value": "in",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := mustAddProduction(t, n, lhs, NewRHS())
+	n.AddWME(NewWME("Order", "O1", "status", "open"))
+	if p.GetItems().Len() != 1 {
+		t.Fatalf("expected forall over no line items to hold, got %d", p.GetItems().Len())
+	}
+	n.AddWME(NewWME("LineItem", "L1", "order", "O1"))
+	n.AddWME(NewWME("LineItem", "L2", "order", "O1"))
+	n.AddWME(NewWME("LineItem", "L1", "stock", "in"))
+	if p.GetItems().Len() != 0 {
+		t.Fatalf("expected L2 out of stock to block, got %d", p.GetItems().Len())
+	}
+	l2 := NewWME("LineItem", "L2", "stock", "in")
+	n.AddWME(l2)
+	if p.GetItems().Len() != 1 {
+		t.Fatalf("expected forall to hold with every line in stock, got %d", p.GetItems().Len())
+	}
+	RemoveWME(l2)
+	if p.GetItems().Len() != 0 {
+		t.Fatalf("expected forall to fail after retracting stock, got %d", p.GetItems().Len())
+	}
+	if _, err := JSONParseLHS([]interface{}{
+		map[string]interface{}{"tag": "forall", "items": []interface{}{}},
+	}); err == nil {
+		t.Error("expected error for forall without requirements")
+	}
+}
+
+func TestAccumulate(t *testing.T) {
+	n := NewNetwork()
+	lhs, err := JSONParseLHS([]interface{}{
+		map[string]interface{}{
+			"tag": "has", "classname": "Quota", "identifier": "$user", "attribute": "limit", "value": "$limit",
+		},
+		map[string]interface{}{
+			"tag": "accumulate", "classname": "ProductSKU", "identifier": "$user", "attribute": "quantity",
+			"value": "$quantity", "function": "sum", "of": "$quantity", "result": "$total",
+		},
+		map[string]interface{}{
+			"tag": "filter", "tmpl": "total > limit",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := mustAddProduction(t, n, lhs, NewRHS())
+	n.AddWME(NewWME("Quota", "U1", "limit", "5"))
+	n.AddWME(NewWME("ProductSKU", "U1", "quantity", "2"))
+	three := NewWME("ProductSKU", "U1", "quantity", "3")
+	n.AddWME(three)
+	n.AddWME(NewWME("ProductSKU", "U2", "quantity", "4"))
+	if p.GetItems().Len() != 0 {
+		t.Fatalf("expected 5 not over quota, got %d", p.GetItems().Len())
+	}
+	n.AddWME(NewWME("ProductSKU", "U1", "quantity", "1"))
+	if p.GetItems().Len() != 1 {
+		t.Fatalf("expected 6 over quota, got %d", p.GetItems().Len())
+	}
+	if total := p.GetItems().Front().Value.(*Token).GetBinding("total"); total != 6.0 {
+		t.Errorf("expected total 6, got %v", total)
+	}
+	RemoveWME(three)
+	if p.GetItems().Len() != 0 {
+		t.Fatalf("expected 3 under quota after retraction, got %d", p.GetItems().Len())
+	}
+
+	// the result joins against later conditions
+	n = NewNetwork()
+	p = mustAddProduction(t, n, NewLHS(
+		NewHas("Order", "$o", "status", "open"),
+		NewAccumulate(NewHas("LineItem", "$li", "order", "$o"), "", Count, "$n"),
+		NewHas("Order", "$o", "expected", "$n"),
+	), NewRHS())
+	n.AddWME(NewWME("Order", "O1", "status", "open"))
+	n.AddWME(NewWME("Order", "O1", "expected", "2"))
+	n.AddWME(NewWME("LineItem", "L1", "order", "O1"))
+	if p.GetItems().Len() != 0 {
+		t.Fatalf("expected no match with one line item, got %d", p.GetItems().Len())
+	}
+	n.AddWME(NewWME("LineItem", "L2", "order", "O1"))
+	if p.GetItems().Len() != 1 {
+		t.Fatalf("expected match with two line items, got %d", p.GetItems().Len())
+	}
+}
+
+func TestReducers(t *testing.T) {
+	values := []string{"4", "1", "x", "7", "1"}
+	expect := map[string]interface{}{"count": 5.0, "sum": 13.0, "min": 1.0, "max": 7.0, "avg": 3.25}
+	for name, want := range expect {
+		r, err := GetReducer(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc := r()
+		for _, v := range values {
+			acc.Add(v)
+		}
+		if got := acc.Result(); got != want {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+	max := Max()
+	max.Add("3")
+	max.Add("9")
+	max.Remove("9")
+	if got := max.Result(); got != 3.0 {
+		t.Errorf("max after removal: expected 3, got %v", got)
+	}
+	max.Remove("3")
+	if got := max.Result(); got != nil {
+		t.Errorf("max of nothing: expected nil, got %v", got)
+	}
+	for _, acc := range []Accumulator{Min(), Max()} {
+		for _, v := range []string{"NaN", "Inf", "-Inf", "2"} {
+			acc.Add(v)
+		}
+		acc.Remove("NaN")
+		if got := acc.Result(); got != 2.0 {
+			t.Errorf("expected non-finite values to be ignored, got %v", got)
+		}
+	}
+	if _, err := GetReducer("median"); err == nil {
+		t.Error("expected error for unknown reducer")
+	}
+}
+
+func TestCollect(t *testing.T) {
+	n := NewNetwork()
+	lhs, err := JSONParseLHS([]interface{}{
+		map[string]interface{}{
+			"tag": "has", "classname": "Table", "identifier": "$t", "attribute": "name", "value": "table",
+		},
+		map[string]interface{}{
+			"tag": "collect", "classname": "Object", "identifier": "$b", "attribute": "on", "value": "table",
+			"of": "$b", "result": "$blocks",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := mustAddProduction(t, n, lhs, NewRHS())
+	w := NewHas("Object", "$b", "on", "table")
+	all := mustAddProduction(t, n, NewLHS(
+		NewHas("Table", "$t", "name", "table"),
+		NewCollect(w, "", "$wmes"),
+	), NewRHS())
+	n.AddWME(NewWME("Table", "T", "name", "table"))
+	if fmt.Sprint(p.GetItems().Front().Value.(*Token).GetBinding("blocks")) != "[]" {
+		t.Fatal("expected an empty collection")
+	}
+	b1 := NewWME("Object", "B1", "on", "table")
+	n.AddWME(b1)
+	n.AddWME(NewWME("Object", "B2", "on", "B1"))
+	n.AddWME(NewWME("Object", "B3", "on", "table"))
+	if p.GetItems().Len() != 1 {
+		t.Fatalf("expected one activation, got %d", p.GetItems().Len())
+	}
+	blocks := p.GetItems().Front().Value.(*Token).GetBinding("blocks")
+	if fmt.Sprint(blocks) != "[B1 B3]" {
+		t.Errorf("expected [B1 B3], got %v", blocks)
+	}
+	wmes := all.GetItems().Front().Value.(*Token).GetBinding("wmes").([]*WME)
+	if len(wmes) != 2 || wmes[0] != b1 {
+		t.Errorf("expected the matching WMEs, got %v", wmes)
+	}
+	RemoveWME(b1)
+	blocks = p.GetItems().Front().Value.(*Token).GetBinding("blocks")
+	if p.GetItems().Len() != 1 || fmt.Sprint(blocks) != "[B3]" {
+		t.Errorf("expected [B3] after retraction, got %v", blocks)
+	}
+}
+
+func TestRemoveProduction(t *testing.T) {
+	n := NewNetwork()
+	c0 := NewHas("Object", "$x", "on", "$y")
+	p0 := mustAddProduction(t, n, NewLHS(c0, NewHas("Object", "$y", "color", "red")), NewRHS())
+	p1 := mustAddProduction(t, n, NewLHS(c0, NewNeg("Object", "$y", "color", "blue")), NewRHS())
+	wmes := []*WME{
+		NewWME("Object", "B1", "on", "B2"),
+		NewWME("Object", "B2", "color", "red"),
+	}
+	for _, w := range wmes {
+		n.AddWME(w)
+	}
+	if p0.GetItems().Len() != 1 || p1.GetItems().Len() != 1 {
+		t.Fatal("expected both productions to match")
+	}
+	if err := n.RemoveProduction(p0); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.PNodes) != 1 || p0.GetItems().Len() != 0 {
+		t.Errorf("expected p0 gone, got %d p-nodes", len(n.PNodes))
+	}
+	if wmes[1].alphaMems.Len() != 1 || wmes[1].tokens.Len() != 0 {
+		t.Error("expected the unused alpha memory and tokens to be deleted")
+	}
+	// the alpha memory for c0 is still used by p1
+	n.AddWME(NewWME("Object", "B3", "on", "B4"))
+	if p1.GetItems().Len() != 2 {
+		t.Errorf("expected p1 to keep matching, got %d", p1.GetItems().Len())
+	}
+	if err := n.RemoveProduction(p0); err == nil {
+		t.Error("expected error removing a production twice")
+	}
+	if err := n.RemoveProduction(p1); err != nil {
+		t.Fatal(err)
+	}
+	if n.alphaRoot.children.Len() != 0 || n.betaRoot.GetChildren().Len() != 0 {
+		t.Error("expected an empty network")
+	}
+}
+
+func TestReplaceProductions(t *testing.T) {
+	n := NewNetwork()
+	c0 := NewHas("Object", "$x", "on", "$y")
+	red := NewLHS(c0, NewHas("Object", "$y", "color", "red"))
+	blue := NewLHS(c0, NewHas("Object", "$y", "color", "blue"))
+	p0 := mustAddProduction(t, n, red, NewRHS())
+	mustAddProduction(t, n, blue, NewRHS())
+	for _, w := range []*WME{
+		NewWME("Object", "B1", "on", "B2"),
+		NewWME("Object", "B2", "color", "red"),
+		NewWME("Object", "B3", "on", "B2"),
+	} {
+		n.AddWME(w)
+	}
+	tok := p0.GetItems().Front().Value.(*Token)
+	report, err := n.ReplaceProductions([]Production{
+		NewProduction(NewLHS(c0, NewNeg("Object", "$y", "color", "blue")), NewRHS()),
+		NewProduction(red, NewRHS()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Kept) != 1 || report.Kept[0] != p0 {
+		t.Error("expected the red production to be kept")
+	}
+	if len(report.Removed) != 1 || len(report.Added) != 1 {
+		t.Errorf("expected one production removed and one added, got %+v", report)
+	}
+	if len(n.PNodes) != 2 || n.PNodes[1] != p0 {
+		t.Error("expected p-nodes in the order of the new rule set")
+	}
+	if p0.GetItems().Len() != 2 || p0.GetItems().Front().Value.(*Token) != tok {
+		t.Error("expected the kept production to keep its tokens")
+	}
+	if report.Added[0].GetItems().Len() != 2 {
+		t.Errorf("expected the added production to match working memory, got %d",
+			report.Added[0].GetItems().Len())
+	}
+	if _, err := n.ReplaceProductions(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n.alphaRoot.children.Len() != 0 || n.betaRoot.GetChildren().Len() != 0 {
+		t.Error("expected an empty network")
+	}
+}
+
+func TestReplaceRules(t *testing.T) {
+	n := NewNetwork()
+	adult := rules.Rule{
+		Name: "AdultUser",
+		Conditions: rules.Conditions{
+			All: []rules.Condition{{Fact: "age", Operator: "greaterThanOrEqual", Value: 18}},
+			Any: []rules.Condition{
+				{Fact: "country", Operator: "equal", Value: "NL"},
+				{Fact: "country", Operator: "notEqual", Value: "US"},
+			},
+		},
+		Event: rules.RuleEvent{EventType: "Adult"},
+	}
+	if _, err := n.ReplaceRules([]rules.Rule{adult}); err != nil {
+		t.Fatal(err)
+	}
+	n.AddWME(NewWME("User", "U1", "age", "20"))
+	n.AddWME(NewWME("User", "U1", "country", "US"))
+	n.AddWME(NewWME("User", "U2", "age", "30"))
+	n.AddWME(NewWME("User", "U2", "country", "NL"))
+	n.AddWME(NewWME("User", "U3", "age", "10"))
+	n.AddWME(NewWME("User", "U3", "country", "NL"))
+	var fired []string
+	env := Env{"Adult": func(n *Network, tok *Token) {
+		fired = append(fired, tok.GetBinding("id").(string))
+	}}
+	if err := n.ExecuteRules(env); err != nil {
+		t.Fatal(err)
+	}
+	if len(fired) != 1 || fired[0] != "U2" {
+		t.Errorf("expected U2 to fire, got %v", fired)
+	}
+	_, err := n.ReplaceRules([]rules.Rule{{Name: "bad", Conditions: rules.Conditions{
+		All: []rules.Condition{{Fact: "age", Operator: "between", Value: 1}},
+	}}})
+	if err == nil || len(n.PNodes) != 1 {
+		t.Error("expected an invalid rule to leave the network unchanged")
+	}
+}
+
+func TestValidation(t *testing.T) {
+	n := NewNetwork()
+	c0 := NewHas("Object", "$x", "qty", "$qty")
+	valid := []LHS{
+		NewLHS(c0, Filter{tmpl: "$qty > 3 && startsWith($x, \"B\")"}),
+		NewLHS(c0, NewNccRule(NewHas("Object", "$y", "on", "$x"), Filter{tmpl: "$y != $x"})),
+		NewLHS(c0, NewAccumulate(NewHas("Object", "$x", "on", "$y"), "$y", Count, "$n"), Filter{tmpl: "n > qty"}),
+		NewLHS(c0, Filter{tmpl: `$qty == "3"`}),
+		NewLHS(c0, Filter{tmpl: `$x in ["A", $qty]`}),
+		NewLHS(c0, Filter{tmpl: `now() - $qty > "24h"`}),
+		NewLHS(c0, Filter{tmpl: `$qty + "1h" > now()`}),
+	}
+	for _, lhs := range valid {
+		if _, err := n.AddProduction(lhs, NewRHS()); err != nil {
+			t.Errorf("%s: %v", describe(lhs), err)
+		}
+	}
+	invalid := []LHS{
+		NewLHS(),
+		NewLHS(NewNeg("Object", "$x", "qty", "$qty")),
+		NewLHS(c0, Filter{tmpl: "$qyt > 3"}),
+		NewLHS(c0, Filter{tmpl: "lenght($x) > 3"}),
+		NewLHS(c0, Filter{tmpl: `"abc" > 1`}),
+		NewLHS(c0, Filter{tmpl: "$qty + 1"}),
+		NewLHS(c0, Filter{tmpl: "!3 || $qty > 1"}),
+		NewLHS(c0, Filter{tmpl: "$qty >"}),
+		NewLHS(c0, Filter{tmpl: "$x in [$qyt]"}),
+		NewLHS(c0, Filter{tmpl: "$user.tier == 1"}),
+		NewLHS(c0, NewNeg("Object", "$x", "on", "$y"), Filter{tmpl: "$y > 1"}),
+		NewLHS(c0, NewNccRule(NewHas("Object", "$y", "on", "$x")), Filter{tmpl: "$y > 1"}),
+		NewLHS(c0, NewAccumulate(NewHas("Object", "$x", "on", "$y"), "$z", Sum, "$n")),
+	}
+	for _, lhs := range invalid {
+		if _, err := n.AddProduction(lhs, NewRHS()); err == nil {
+			t.Errorf("%s: expected error", describe(lhs))
+		}
+	}
+	if len(n.PNodes) != len(valid) {
+		t.Errorf("expected only valid productions added, got %d", len(n.PNodes))
+	}
+	for _, tmpl := range []string{"$qyt > 3", "lenn($x) > 1"} {
+		_, err := FromJSON(`{"productions": [{"rhs": {}, "lhs": [
+			{"tag": "has", "classname": "Object", "identifier": "$x", "attribute": "qty", "value": "$qty"},
+			{"tag": "filter", "tmpl": "` + tmpl + `"}
+		]}]}`)
+		if err == nil {
+			t.Errorf("%s: expected FromJSON to report an error", tmpl)
+		}
+	}
+}
+
+func TestFilterErrorPolicy(t *testing.T) {
+	lhs := NewLHS(NewHas("Object", "$x", "qty", "$qty"), Filter{tmpl: "$qty > 3"})
+	for policy, want := range map[FilterErrorPolicy]int{
+		FilterErrorFalse: 1, FilterErrorTrue: 2, FilterErrorHalt: 1, FilterErrorRecord: 1,
+	} {
+		n := NewNetwork()
+		n.SetFilterErrorPolicy(policy)
+		var seen []*FilterError
+		n.OnFilterError(func(e *FilterError) { seen = append(seen, e) })
+		p := mustAddProduction(t, n, lhs, NewRHS())
+		n.AddWME(NewWME("Object", "B1", "qty", "5"))
+		n.AddWME(NewWME("Object", "B2", "qty", "many"))
+		if p.GetItems().Len() != want {
+			t.Errorf("policy %d: expected %d matches, got %d", policy, want, p.GetItems().Len())
+		}
+		if len(seen) != 1 || seen[0].Bindings["x"] != "B2" || seen[0].Expr != "$qty > 3" {
+			t.Errorf("policy %d: expected the callback to see the error, got %v", policy, seen)
+		}
+		recorded := policy == FilterErrorHalt || policy == FilterErrorRecord
+		if got := len(n.FilterErrors()); got != 1 && recorded || got != 0 && !recorded {
+			t.Errorf("policy %d: got %d recorded errors", policy, got)
+		}
+		fired := 0
+		err := n.ExecuteRules(Env{"F": func(*Network, *Token) { fired++ }})
+		if policy == FilterErrorHalt && (err == nil || fired != 0) {
+			t.Errorf("expected halt, got %v after %d firings", err, fired)
+		}
+		if policy != FilterErrorHalt && err != nil {
+			t.Error(err)
+		}
+	}
+	n := NewNetwork()
+	n.SetFilterErrorPolicy(FilterErrorHalt)
+	mustAddProduction(t, n, lhs, RHS{tmpl: "F"})
+	n.AddWME(NewWME("Object", "B2", "qty", "many"))
+	n.AddWME(NewWME("Object", "B1", "qty", "5"))
+	n.ClearFilterErrors()
+	fired := 0
+	if err := n.ExecuteRules(Env{"F": func(*Network, *Token) { fired++ }}); err != nil || fired != 1 {
+		t.Errorf("expected a firing after clearing, got %v after %d firings", err, fired)
+	}
+}
+
+func TestBind(t *testing.T) {
+	n := NewNetwork()
+	lhs, err := JSONParseLHS([]interface{}{
+		map[string]interface{}{
+			"tag": "has", "classname": "Item", "identifier": "$i", "attribute": "qty", "value": "$qty",
+		},
+		map[string]interface{}{
+			"tag": "has", "classname": "Item", "identifier": "$i", "attribute": "price", "value": "$price",
+		},
+		map[string]interface{}{
+			"tag": "bind", "result": "$total", "tmpl": "$qty * $price",
+		},
+		map[string]interface{}{
+			"tag": "has", "classname": "Budget", "identifier": "$b", "attribute": "limit", "value": "$total",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := mustAddProduction(t, n, lhs, NewRHS())
+	n.AddWME(NewWME("Budget", "X", "limit", "6"))
+	n.AddWME(NewWME("Item", "I1", "qty", "3"))
+	price := NewWME("Item", "I1", "price", "2")
+	n.AddWME(price)
+	n.AddWME(NewWME("Item", "I2", "qty", "3"))
+	n.AddWME(NewWME("Item", "I2", "price", "5"))
+	if p.GetItems().Len() != 1 {
+		t.Fatalf("expected only I1 to join on its total, got %d", p.GetItems().Len())
+	}
+	tok := p.GetItems().Front().Value.(*Token)
+	if total := tok.GetBinding("total"); bindingString(total) != "6" || tok.GetBinding("b") != "X" {
+		t.Errorf("expected total 6 for budget X, got %v", tok.AllBinding())
+	}
+	RemoveWME(price)
+	if p.GetItems().Len() != 0 {
+		t.Errorf("expected the match gone with its price, got %d", p.GetItems().Len())
+	}
+
+	// a filter on the bound value
+	p = mustAddProduction(t, n, NewLHS(
+		NewHas("Item", "$i", "qty", "$qty"),
+		NewBind("$double", "$qty * 2"),
+		Filter{tmpl: "$double > 6"},
+	), NewRHS())
+	if p.GetItems().Len() != 0 {
+		t.Errorf("expected 6 not over 6, got %d", p.GetItems().Len())
+	}
+	n.AddWME(NewWME("Item", "I3", "qty", "4"))
+	if p.GetItems().Len() != 1 {
+		t.Fatalf("expected 8 over 6, got %d", p.GetItems().Len())
+	}
+	if double := p.GetItems().Front().Value.(*Token).GetBinding("double"); double != 8.0 {
+		t.Errorf("expected 8, got %v", double)
+	}
+	if _, err := n.AddProduction(NewLHS(
+		NewHas("Item", "$i", "qty", "$qty"), NewBind("$qty", "$qty + 1"),
+	), NewRHS()); err == nil {
+		t.Error("expected error rebinding a variable")
+	}
+}
+
+func TestClock(t *testing.T) {
+	n := NewNetwork()
+	clock := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	n.SetClock(func() time.Time { return clock })
+	p := mustAddProduction(t, n, NewLHS(
+		NewHas("Account", "$a", "created", "$created"),
+		Filter{tmpl: `now() - $created > duration("168h")`},
+	), NewRHS())
+	n.AddWME(NewWME("Account", "A1", "created", "2024-01-01T00:00:00Z"))
+	n.AddWME(NewWME("Account", "A2", "created", "2024-01-05"))
+	if p.GetItems().Len() != 1 || p.GetItems().Front().Value.(*Token).GetBinding("a") != "A1" {
+		t.Errorf("expected only A1 older than a week, got %d", p.GetItems().Len())
+	}
+	clock = clock.AddDate(0, 0, 10)
+	n.AddWME(NewWME("Account", "A3", "created", "2024-01-05"))
+	if p.GetItems().Len() != 2 {
+		t.Errorf("expected A3 older than a week by the new clock, got %d", p.GetItems().Len())
+	}
+}
+
+func TestSetDecimalMode(t *testing.T) {
+	lhs := NewLHS(
+		NewHas("Order", "$o", "price", "$price"),
+		NewHas("Order", "$o", "fee", "$fee"),
+		NewBind("$total", "$price + $fee"),
+		NewHas("Budget", "$b", "limit", "$total"),
+	)
+	for _, mode := range []*DecimalMode{nil, {Scale: 2}} {
+		n := NewNetwork()
+		n.SetDecimalMode(mode)
+		p := mustAddProduction(t, n, lhs, NewRHS())
+		n.AddWME(NewWME("Budget", "B", "limit", "0.3"))
+		n.AddWME(NewWME("Order", "O1", "price", "0.1"))
+		n.AddWME(NewWME("Order", "O1", "fee", "0.2"))
+		if want := map[bool]int{true: 0, false: 1}[mode == nil]; p.GetItems().Len() != want {
+			t.Errorf("mode %v: expected %d matches of 0.1 + 0.2 on 0.3, got %d", mode, want, p.GetItems().Len())
+		}
+		sum := mustAddProduction(t, n, NewLHS(
+			NewHas("Budget", "$b", "limit", "$limit"),
+			NewAccumulate(NewHas("Order", "$x", "price", "$p"), "$p", Sum, "$sum"),
+		), NewRHS())
+		n.AddWME(NewWME("Order", "O2", "price", "0.2"))
+		r := sum.GetItems().Front().Value.(*Token).AllBinding()["sum"]
+		if _, ok := r.(Decimal); ok != (mode != nil) {
+			t.Errorf("mode %v: unexpected sum %v (%T)", mode, r, r)
+		}
+		if f, _ := asFloat(r); f != 0.3 {
+			t.Errorf("mode %v: expected a sum of 0.3, got %v", mode, r)
+		}
+	}
+}
+
+func TestEvalLimits(t *testing.T) {
+	n := NewNetwork()
+	n.SetFilterErrorPolicy(FilterErrorRecord)
+	n.RegisterFunction("sleepy", func(args ...interface{}) (interface{}, error) {
+		time.Sleep(5 * time.Millisecond)
+		return true, nil
+	})
+	block := make(chan struct{})
+	defer close(block)
+	n.RegisterFunction("stuck", func(args ...interface{}) (interface{}, error) {
+		<-block
+		return true, nil
+	})
+	n.SetEvalLimits(EvalLimits{
+		MaxDepth:         6,
+		MaxOperations:    4,
+		Timeout:          time.Millisecond,
+		AllowedFunctions: []string{"abs", "sleepy", "stuck"},
+	})
+	c0 := NewHas("Object", "$x", "qty", "$qty")
+	for _, tmpl := range []string{`((($qty + 1) * 2) - 3) > 4`, `len($x) > 1`} {
+		if _, err := n.AddProduction(NewLHS(c0, Filter{tmpl: tmpl}), NewRHS()); err == nil {
+			t.Errorf("%s: expected error", tmpl)
+		}
+	}
+	if _, err := NewNetwork().AddProduction(NewLHS(c0, Filter{tmpl: `sleepy()`}), NewRHS()); err == nil {
+		t.Error("expected a function of another network to be undefined")
+	}
+	ok := mustAddProduction(t, n, NewLHS(c0, Filter{tmpl: `abs($qty) > 1`}), NewRHS())
+	long := mustAddProduction(t, n, NewLHS(c0, Filter{tmpl: `$qty > 1 && $qty > 2 && $qty > 3`}), NewRHS())
+	slow := mustAddProduction(t, n, NewLHS(c0, Filter{tmpl: `sleepy() && $qty > 1`}), NewRHS())
+	stuck := mustAddProduction(t, n, NewLHS(c0, Filter{tmpl: `stuck()`}), NewRHS())
+	n.AddWME(NewWME("Object", "B1", "qty", "-5"))
+	n.AddWME(NewWME("Object", "B2", "qty", "5"))
+	if ok.GetItems().Len() != 2 || long.GetItems().Len() != 0 || slow.GetItems().Len() != 0 || stuck.GetItems().Len() != 0 {
+		t.Errorf("expected only the filter within limits to match, got %d, %d, %d and %d",
+			ok.GetItems().Len(), long.GetItems().Len(), slow.GetItems().Len(), stuck.GetItems().Len())
+	}
+	errs := n.FilterErrors()
+	if len(errs) != 5 {
+		t.Fatalf("expected 5 recorded errors, got %v", errs)
+	}
+	for _, e := range errs {
+		if !errors.Is(e, ErrEvalLimit) {
+			t.Errorf("expected a limit error, got %v", e)
+		}
+	}
+}
+
+func TestFunctionPanic(t *testing.T) {
+	for _, limits := range []EvalLimits{{}, {Timeout: time.Second}} {
+		n := NewNetwork()
+		n.SetFilterErrorPolicy(FilterErrorRecord)
+		n.SetEvalLimits(limits)
+		n.RegisterFunction("boom", func(args ...interface{}) (interface{}, error) {
+			panic("boom")
+		})
+		pnode := mustAddProduction(t, n, NewLHS(NewHas("Object", "$x", "v", "$v"), Filter{tmpl: `boom($v)`}), NewRHS())
+		n.AddWME(NewWME("Object", "B1", "v", "1"))
+		if pnode.GetItems().Len() != 0 {
+			t.Errorf("timeout %s: expected no match", limits.Timeout)
+		}
+		if errs := n.FilterErrors(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "panic: boom") {
+			t.Errorf("timeout %s: expected the panic to be recorded, got %v", limits.Timeout, errs)
+		}
+	}
+}
+
+func TestActionRegistry(t *testing.T) {
+	errFailed := errors.New("failed")
+	var fired []string
+	r := NewActionRegistry()
+	for name, err := range map[string]error{"ok": nil, "fail": errFailed} {
+		name, err := name, err
+		if e := r.Register(name, func(ctx context.Context, n *Network, tok *Token) error {
+			fired = append(fired, name+" "+tok.GetBinding("x").(string))
+			return err
+		}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if err := r.Register("ok", func(context.Context, *Network, *Token) error { return nil }); err == nil {
+		t.Error("expected error registering a name twice")
+	}
+
+	n := NewNetwork()
+	c0 := NewHas("Object", "$x", "qty", "$qty")
+	mustAddProduction(t, n, NewLHS(c0), RHS{tmpl: "missing"})
+	if err := n.SetActionRegistry(r); err == nil {
+		t.Error("expected error for the production without a handler")
+	}
+	n = NewNetwork()
+	if err := n.SetActionRegistry(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.AddProduction(NewLHS(c0), RHS{tmpl: "missing"}); err == nil {
+		t.Error("expected error adding a production without a handler")
+	}
+	mustAddProduction(t, n, NewLHS(c0), RHS{tmpl: "ok"})
+	n.AddWME(NewWME("Object", "B1", "qty", "1"))
+	if err := n.ExecuteRules(nil); err != nil || fmt.Sprint(fired) != "[ok B1]" {
+		t.Errorf("expected [ok B1], got %v (%v)", fired, err)
+	}
+	mustAddProduction(t, n, NewLHS(c0), RHS{tmpl: "fail"})
+	if err := n.ExecuteRules(nil); !errors.Is(err, errFailed) {
+		t.Errorf("expected the handler error, got %v", err)
+	}
+
+	n = NewNetwork()
+	mustAddProduction(t, n, NewLHS(c0), RHS{tmpl: "h"})
+	n.AddWME(NewWME("Object", "B1", "qty", "1"))
+	if err := n.ExecuteRules(Env{"h": 3}); err == nil {
+		t.Error("expected error for a handler of the wrong type")
+	}
+	ok, _ := r.Lookup("ok")
+	fired = nil
+	if err := n.ExecuteRules(Env{"h": ok}); err != nil || fmt.Sprint(fired) != "[ok B1]" {
+		t.Errorf("expected [ok B1], got %v (%v)", fired, err)
+	}
+}
+
+func TestFiringErrors(t *testing.T) {
+	errFailed := errors.New("failed")
+	var fired []string
+	handler := func(ctx context.Context, n *Network, tok *Token) error {
+		x := tok.GetBinding("x").(string)
+		fired = append(fired, x)
+		switch x {
+		case "B1":
+			panic("boom")
+		case "B2":
+			return errFailed
+		}
+		return nil
+	}
+	for policy, want := range map[FiringErrorPolicy]int{StopOnError: 1, ContinueOnError: 2} {
+		fired = nil
+		n := NewNetwork()
+		var buf bytes.Buffer
+		n.SetLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+		n.SetFiringErrorPolicy(policy)
+		mustAddProduction(t, n, NewLHS(NewHas("Object", "$x", "qty", "$qty")), RHS{
+			tmpl:  "h",
+			Extra: map[string]interface{}{"name": "check qty"},
+		})
+		for _, id := range []string{"B1", "B2", "B3"} {
+			n.AddWME(NewWME("Object", id, "qty", "1"))
+		}
+		err := n.ExecuteRules(Env{"h": ActionHandler(handler)})
+		joined, ok := err.(interface{ Unwrap() []error })
+		if !ok || len(joined.Unwrap()) != want {
+			t.Fatalf("policy %d: expected %d errors, got %v", policy, want, err)
+		}
+		for _, e := range joined.Unwrap() {
+			var fe *FiringError
+			if !errors.As(e, &fe) || fe.Production != "check qty" || fe.Token == nil {
+				t.Errorf("expected a FiringError of check qty, got %v", e)
+			}
+		}
+		if strings.Count(buf.String(), "firing failed") != want {
+			t.Errorf("expected %d logged failures, got %q", want, buf.String())
+		}
+		if policy == StopOnError {
+			if len(fired) == 3 {
+				t.Errorf("expected the firing to stop, got %v", fired)
+			}
+			continue
+		}
+		var p *PanicError
+		if len(fired) != 3 || !errors.Is(err, errFailed) || !errors.As(err, &p) || p.Value != "boom" {
+			t.Errorf("expected 3 firings, a panic and a handler error, got %v: %v", fired, err)
+		}
+	}
+}
+
+func TestExecuteRulesContext(t *testing.T) {
+	type key struct{}
+	n := NewNetwork()
+	mustAddProduction(t, n, NewLHS(NewHas("Object", "$x", "qty", "$qty")), RHS{tmpl: "h"})
+	mustAddProduction(t, n, NewLHS(NewHas("Object", "$x", "qty", "$qty"), Filter{tmpl: "$qty > 0"}), RHS{tmpl: "unhandled"})
+	for i := 0; i < 5; i++ {
+		n.AddWME(NewWME("Object", fmt.Sprint("B", i), "qty", "1"))
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "v"))
+	fired := 0
+	handler := ActionHandler(func(ctx context.Context, n *Network, tok *Token) error {
+		if ctx.Value(key{}) != "v" {
+			t.Error("expected the context of the run")
+		}
+		if fired++; fired == 2 {
+			cancel()
+		}
+		return nil
+	})
+	report, err := n.ExecuteRulesContext(ctx, Env{"h": handler})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the run canceled, got %v", err)
+	}
+	if report != (RunReport{Fired: 2, Pending: 3}) {
+		t.Errorf("expected 2 fired and 3 pending, got %+v", report)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	block := ActionHandler(func(ctx context.Context, n *Network, tok *Token) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	start := time.Now()
+	report, err = n.ExecuteRulesContext(ctx, Env{"h": block})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("expected the run to time out promptly, got %v", err)
+	}
+	if report.Fired != 1 || report.Failed != 1 || report.Pending != 4 {
+		t.Errorf("expected 1 failed firing and 4 pending, got %+v", report)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	ps, err := FromJSON(`{"productions": [{"lhs": [
+		{"tag": "has", "classname": "Order", "identifier": "$id", "attribute": "total", "value": "$t"},
+		{"tag": "filter", "tmpl": "$t > 100"}
+	], "rhs": {"name": "big order", "template": "{{.name}}: order {{.id}} totals {{.t}}"}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNetwork()
+	if _, err := n.ReplaceProductions(ps); err != nil {
+		t.Fatal(err)
+	}
+	n.AddWME(NewWME("Order", "O1", "total", "150"))
+	n.AddWME(NewWME("Order", "O2", "total", "50"))
+	if err := n.ExecuteRules(nil); err == nil {
+		t.Error("expected error for output without a sink")
+	}
+	var outputs []Output
+	n.SetSink(func(ctx context.Context, out Output) error {
+		outputs = append(outputs, out)
+		return nil
+	})
+	if err := n.ExecuteRules(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 1 || outputs[0].Text != "big order: order O1 totals 150" || outputs[0].Production != "big order" {
+		t.Errorf("expected the output of O1, got %+v", outputs)
+	}
+	n.SetSink(func(ctx context.Context, out Output) error {
+		panic("sink closed")
+	})
+	var p *PanicError
+	if err := n.ExecuteRules(nil); !errors.As(err, &p) || p.Value != "sink closed" {
+		t.Errorf("expected the panic of the sink, got %v", err)
+	}
+
+	lhs := NewLHS(NewHas("Order", "$id", "total", "$t"))
+	rhs := NewRHS()
+	if err := rhs.SetTemplate("{{if .t}}{{.missing}}{{end}}"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.AddProduction(lhs, rhs); err == nil {
+		t.Error("expected error for an unbound field")
+	}
+	if _, err := n.ReplaceProductions([]Production{NewProduction(lhs, rhs)}); err == nil {
+		t.Error("expected ReplaceProductions to report the unbound field")
+	}
+	rhs.Extra["missing"] = "extra"
+	if err := rhs.SetTemplate("{{.missing}} {{range .t}}{{.Name}}{{end}}"); err != nil {
+		t.Fatal(err)
+	}
+	mustAddProduction(t, n, lhs, rhs)
+	if err := rhs.SetTemplate("{{.id"); err == nil {
+		t.Error("expected error for a bad template")
+	}
+	if _, err := FromJSON(`{"productions": [{"rhs": {"template": "{{"}, "lhs": [
+		{"tag": "has", "classname": "A", "identifier": "$x", "attribute": "b", "value": "c"}]}]}`); err == nil {
+		t.Error("expected FromJSON to report the bad template")
+	}
+	if _, err := FromJSON(`{"productions": [{"rhs": {"template": "{{.y}}"}, "lhs": [
+		{"tag": "has", "classname": "A", "identifier": "$x", "attribute": "b", "value": "c"}]}]}`); err == nil {
+		t.Error("expected FromJSON to report the unbound field")
+	}
+}
+
+func TestTruthMaintenance(t *testing.T) {
+	ps, err := FromJSON(`{"productions": [
+		{"lhs": [
+			{"tag": "has", "classname": "Order", "identifier": "$id", "attribute": "total", "value": "$t"},
+			{"tag": "filter", "tmpl": "$t > 100"}
+		], "rhs": {"assert": {"classname": "Order", "identifier": "$id", "attribute": "size", "value": "big", "logical": true}}},
+		{"lhs": [
+			{"tag": "has", "classname": "Order", "identifier": "$id", "attribute": "vip", "value": "yes"}
+		], "rhs": {"assert": {"classname": "Order", "identifier": "$id", "attribute": "size", "value": "big", "logical": true}}},
+		{"lhs": [
+			{"tag": "has", "classname": "Order", "identifier": "$id", "attribute": "size", "value": "big"}
+		], "rhs": {"assert": {"classname": "Discount", "identifier": "$id", "attribute": "rate", "value": "10", "logical": true}}}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNetwork()
+	if _, err := n.ReplaceProductions(ps); err != nil {
+		t.Fatal(err)
+	}
+	memory := func() string {
+		var ret []string
+		for _, w := range n.workingMemory() {
+			ret = append(ret, w.String())
+		}
+		sort.Strings(ret)
+		return fmt.Sprint(ret)
+	}
+	total, vip := NewWME("Order", "O1", "total", "150"), NewWME("Order", "O1", "vip", "yes")
+	n.AddWME(total)
+	n.AddWME(vip)
+	if err := n.ExecuteRules(nil); err != nil {
+		t.Fatal(err)
+	}
+	derived := "[Discount O1 rate 10] [Order O1 size big]"
+	if got := memory(); got != "["+derived+" [Order O1 total 150] [Order O1 vip yes]]" {
+		t.Errorf("expected derived facts, got %s", got)
+	}
+	n.RemoveWME(total)
+	if got := memory(); got != "["+derived+" [Order O1 vip yes]]" {
+		t.Errorf("expected the facts still supported by vip, got %s", got)
+	}
+	n.RemoveWME(vip)
+	if got := memory(); got != "[]" {
+		t.Errorf("expected the retraction to cascade, got %s", got)
+	}
+
+	// a stated fact needs no support, and a removed production withdraws its
+	stated := NewWME("Order", "O2", "size", "big")
+	n.AddWME(stated)
+	p := mustAddProduction(t, n, NewLHS(NewHas("Order", "$id", "size", "$size")), RHS{tmpl: "h"})
+	h := ActionHandler(func(ctx context.Context, n *Network, tok *Token) error {
+		if err := n.AssertLogical(tok, NewWME("Order", "O2", "size", "big")); err != nil {
+			return err
+		}
+		return n.AssertLogical(tok, NewWME("Order", "O2", "checked", "yes"))
+	})
+	if err := n.ExecuteRules(Env{"h": h}); err != nil {
+		t.Fatal(err)
+	}
+	if got := memory(); got != "[[Discount O2 rate 10] [Order O2 checked yes] [Order O2 size big]]" {
+		t.Errorf("expected facts of O2, got %s", got)
+	}
+	if err := n.RemoveProduction(p); err != nil {
+		t.Fatal(err)
+	}
+	if got := memory(); got != "[[Discount O2 rate 10] [Order O2 size big]]" {
+		t.Errorf("expected the facts of the removed production retracted, got %s", got)
+	}
+
+	// a logical WME retracted by hand loses its support, so added back it is
+	// a stated fact
+	n = NewNetwork()
+	mustAddProduction(t, n, NewLHS(NewHas("Order", "$id", "vip", "yes")), RHS{tmpl: "h"})
+	h = ActionHandler(func(ctx context.Context, n *Network, tok *Token) error {
+		return n.AssertLogical(tok, NewWME("Order", tok.GetBinding("id").(string), "gold", "yes"))
+	})
+	vip = NewWME("Order", "O3", "vip", "yes")
+	n.AddWME(vip)
+	if err := n.ExecuteRules(Env{"h": h}); err != nil {
+		t.Fatal(err)
+	}
+	var gold *WME
+	for _, w := range n.workingMemory() {
+		if w.fields[2] == "gold" {
+			gold = w
+		}
+	}
+	n.RemoveWME(gold)
+	if len(n.tms.supports) != 0 || len(n.tms.justifies) != 0 {
+		t.Errorf("expected no support left, got %v and %v", n.tms.supports, n.tms.justifies)
+	}
+	n.AddWME(gold)
+	n.RemoveWME(vip)
+	if got := memory(); got != "[[Order O3 gold yes]]" {
+		t.Errorf("expected the stated fact kept, got %s", got)
+	}
+
+	// a handler removing a WME with the package-level RemoveWME is settled
+	vip = NewWME("Order", "O4", "vip", "yes")
+	n.AddWME(vip)
+	n.AddWME(NewWME("Order", "O4", "expired", "yes"))
+	mustAddProduction(t, n, NewLHS(NewHas("Order", "$id", "expired", "yes")), RHS{tmpl: "expire"})
+	expire := ActionHandler(func(ctx context.Context, n *Network, tok *Token) error {
+		RemoveWME(vip)
+		return nil
+	})
+	if err := n.ExecuteRules(Env{"h": h, "expire": expire}); err != nil {
+		t.Fatal(err)
+	}
+	if got := memory(); strings.Contains(got, "O4 gold") {
+		t.Errorf("expected the fact supported by the removed WME retracted, got %s", got)
+	}
+}
+
+type recordingListener struct {
+	BaseListener
+	events []string
+}
+
+func (l *recordingListener) WMEAsserted(w *WME)  { l.events = append(l.events, "assert "+w.fields[1]) }
+func (l *recordingListener) WMERetracted(w *WME) { l.events = append(l.events, "retract "+w.fields[1]) }
+func (l *recordingListener) ActivationCreated(p *BetaMemory, tok *Token) {
+	l.events = append(l.events, "create "+tok.GetBinding("x").(string))
+}
+func (l *recordingListener) ActivationCancelled(p *BetaMemory, tok *Token) {
+	l.events = append(l.events, "cancel "+tok.GetBinding("x").(string))
+}
+func (l *recordingListener) BeforeFire(p *BetaMemory, tok *Token) {
+	l.events = append(l.events, "before "+tok.GetBinding("x").(string))
+}
+func (l *recordingListener) AfterFire(p *BetaMemory, tok *Token, err error, d time.Duration) {
+	var fe *FiringError
+	l.events = append(l.events, fmt.Sprintf("after %s %v", tok.GetBinding("x"), errors.As(err, &fe) && d >= 0))
+}
+
+func TestListeners(t *testing.T) {
+	n := NewNetwork()
+	l1, l2 := &recordingListener{}, &recordingListener{}
+	n.AddListener(l1)
+	n.AddListener(l2)
+	b1 := NewWME("Object", "B1", "qty", "1")
+	n.AddWME(b1)
+	mustAddProduction(t, n, NewLHS(NewHas("Object", "$x", "qty", "$qty")), RHS{tmpl: "h"})
+	n.AddWME(NewWME("Object", "B2", "qty", "2"))
+	h := ActionHandler(func(ctx context.Context, n *Network, tok *Token) error {
+		if tok.GetBinding("x") == "B2" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if err := n.ExecuteRules(Env{"h": h}); err == nil {
+		t.Error("expected the error of B2")
+	}
+	n.RemoveWME(b1)
+	want := "[assert B1 create B1 assert B2 create B2 before B1 after B1 false before B2 after B2 true retract B1 cancel B1]"
+	for _, l := range []*recordingListener{l1, l2} {
+		if fmt.Sprint(l.events) != want {
+			t.Errorf("expected %s, got %v", want, l.events)
+		}
+	}
+	n.RemoveListener(l1)
+	n.AddWME(b1)
+	if len(l1.events) != 10 || len(l2.events) != 12 {
+		t.Errorf("expected only l2 told, got %v and %v", l1.events, l2.events)
+	}
+	n.RemoveWME(NewWME("Object", "B3", "qty", "3"))
+	if len(l2.events) != 12 {
+		t.Errorf("expected no event for a WME not in working memory, got %v", l2.events)
+	}
+}
@@ -0,0 +1,220 @@
+package rete
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// Accumulator keeps the aggregate of the values matched for one parent token.
+// Remove is only called with a value previously passed to Add. A nil Result
+// means there is no aggregate, and the accumulate condition does not match.
+type Accumulator interface {
+	Add(value string)
+	Remove(value string)
+	Result() interface{}
+}
+
+// Reducer creates an empty Accumulator.
+type Reducer func() Accumulator
+
+var reducersLock sync.RWMutex
+
+var reducers = map[string]Reducer{
+	"count": Count,
+	"sum":   Sum,
+	"min":   Min,
+	"max":   Max,
+	"avg":   Avg,
+}
+
+// RegisterReducer makes a custom reducer available to the `function` field of
+// JSON accumulate conditions.
+func RegisterReducer(name string, r Reducer) {
+	reducersLock.Lock()
+	defer reducersLock.Unlock()
+	reducers[name] = r
+}
+
+func GetReducer(name string) (Reducer, error) {
+	reducersLock.RLock()
+	defer reducersLock.RUnlock()
+	r, ok := reducers[name]
+	if !ok {
+		return nil, fmt.Errorf("reducer `%s` undefined", name)
+	}
+	return r, nil
+}
+
+// wmeAccumulator is implemented by accumulators that keep whole WMEs rather
+// than the value of one field.
+type wmeAccumulator interface {
+	addWME(w *WME)
+	removeWME(w *WME)
+}
+
+type countAccumulator struct {
+	n int
+}
+
+func (acc *countAccumulator) Add(value string)    { acc.n++ }
+func (acc *countAccumulator) Remove(value string) { acc.n-- }
+func (acc *countAccumulator) Result() interface{} { return float64(acc.n) }
+
+// Count counts matching WMEs.
+func Count() Accumulator {
+	return &countAccumulator{}
+}
+
+// decimalAccumulator is implemented by accumulators that have an exact
+// result for networks in decimal mode.
+type decimalAccumulator interface {
+	decimalResult(mode *DecimalMode) interface{}
+}
+
+// sumAccumulator skips values that are not numbers. The sum is exact, so
+// removing values does not leave rounding errors behind.
+type sumAccumulator struct {
+	sum big.Rat
+	n   int
+	avg bool
+}
+
+func (acc *sumAccumulator) Add(value string) {
+	if r, ok := asRat(value); ok {
+		acc.sum.Add(&acc.sum, r)
+		acc.n++
+	}
+}
+func (acc *sumAccumulator) Remove(value string) {
+	if r, ok := asRat(value); ok {
+		acc.sum.Sub(&acc.sum, r)
+		acc.n--
+	}
+}
+func (acc *sumAccumulator) Result() interface{} {
+	sum, _ := acc.sum.Float64()
+	if !acc.avg {
+		return sum
+	}
+	if acc.n == 0 {
+		return nil
+	}
+	return sum / float64(acc.n)
+}
+
+// decimalResult is the sum as a Decimal, or the average rounded to the scale
+// of mode.
+func (acc *sumAccumulator) decimalResult(mode *DecimalMode) interface{} {
+	if !acc.avg {
+		return Decimal{new(big.Rat).Set(&acc.sum)}
+	}
+	if acc.n == 0 {
+		return nil
+	}
+	avg := new(big.Rat).Quo(&acc.sum, new(big.Rat).SetInt64(int64(acc.n)))
+	return Decimal{mode.round(avg)}
+}
+
+// Sum adds up numeric values, and is 0 when there are none.
+func Sum() Accumulator {
+	return &sumAccumulator{}
+}
+
+// Avg averages numeric values, and does not match when there are none.
+func Avg() Accumulator {
+	return &sumAccumulator{avg: true}
+}
+
+// extremeAccumulator counts each value so that removing the current extreme
+// only rescans the distinct values left.
+type extremeAccumulator struct {
+	counts  map[float64]int
+	current float64
+	less    func(a, b float64) bool
+}
+
+func (acc *extremeAccumulator) Add(value string) {
+	f, ok := asFloat(value)
+	if !ok {
+		return
+	}
+	if len(acc.counts) == 0 || acc.less(f, acc.current) {
+		acc.current = f
+	}
+	acc.counts[f]++
+}
+func (acc *extremeAccumulator) Remove(value string) {
+	f, ok := asFloat(value)
+	if !ok {
+		return
+	}
+	acc.counts[f]--
+	if acc.counts[f] > 0 {
+		return
+	}
+	delete(acc.counts, f)
+	if f != acc.current {
+		return
+	}
+	first := true
+	for v := range acc.counts {
+		if first || acc.less(v, acc.current) {
+			acc.current = v
+			first = false
+		}
+	}
+}
+func (acc *extremeAccumulator) Result() interface{} {
+	if len(acc.counts) == 0 {
+		return nil
+	}
+	return acc.current
+}
+
+// Min is the smallest numeric value, and does not match when there are none.
+func Min() Accumulator {
+	return &extremeAccumulator{
+		counts: make(map[float64]int),
+		less:   func(a, b float64) bool { return a < b },
+	}
+}
+
+// Max is the largest numeric value, and does not match when there are none.
+func Max() Accumulator {
+	return &extremeAccumulator{
+		counts: make(map[float64]int),
+		less:   func(a, b float64) bool { return a > b },
+	}
+}
+
+// collectAccumulator keeps matching WMEs in the order they were added. Its
+// result is a fresh []*WME, or a []string of one field when field is set.
+type collectAccumulator struct {
+	wmes  []*WME
+	field int
+}
+
+func (acc *collectAccumulator) Add(value string)    {}
+func (acc *collectAccumulator) Remove(value string) {}
+func (acc *collectAccumulator) addWME(w *WME) {
+	acc.wmes = append(acc.wmes, w)
+}
+func (acc *collectAccumulator) removeWME(w *WME) {
+	for idx, v := range acc.wmes {
+		if v == w {
+			acc.wmes = append(acc.wmes[:idx], acc.wmes[idx+1:]...)
+			return
+		}
+	}
+}
+func (acc *collectAccumulator) Result() interface{} {
+	if acc.field == -1 {
+		return append([]*WME{}, acc.wmes...)
+	}
+	ret := make([]string, 0, len(acc.wmes))
+	for _, w := range acc.wmes {
+		ret = append(ret, w.fields[acc.field])
+	}
+	return ret
+}
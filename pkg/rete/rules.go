@@ -0,0 +1,114 @@
+package rete
+
+import (
+	"fmt"
+	"rgehrsitz/rexrete/pkg/rules"
+	"strconv"
+)
+
+// ruleOperators maps the numeric operators of rules.Condition to filter
+// operators.
+var ruleOperators = map[string]string{
+	"equal":                "==",
+	"notEqual":             "!=",
+	"lessThan":             "<",
+	"lessThanInclusive":    "<=",
+	"lessThanOrEqual":      "<=",
+	"greaterThan":          ">",
+	"greaterThanInclusive": ">=",
+	"greaterThanOrEqual":   ">=",
+}
+
+// ProductionsFromRule compiles a rules.Rule. A fact is an attribute of a
+// subject, so every condition of a rule matches WMEs with the same class name
+// and identifier, and the fact name as attribute.
+//
+// The `any` conditions become a negated conjunction of negated conjunctions
+// after the `all` conditions. A rule without `all` conditions has nothing to
+// join them on, so it compiles to one production per `any` condition, each
+// matching only when the earlier ones do not.
+//
+// The RHS handler is the event type, and the rule name, priority and event
+// custom property are available through Token.GetRHSParam.
+func ProductionsFromRule(rule rules.Rule) ([]Production, error) {
+	var all []interface{}
+	for i, cond := range rule.Conditions.All {
+		items, err := ruleCondition(cond, i)
+		if err != nil {
+			return nil, fmt.Errorf("rule `%s`: %w", rule.Name, err)
+		}
+		all = append(all, items...)
+	}
+	var alternatives [][]interface{}
+	for i, cond := range rule.Conditions.Any {
+		items, err := ruleCondition(cond, len(rule.Conditions.All)+i)
+		if err != nil {
+			return nil, fmt.Errorf("rule `%s`: %w", rule.Name, err)
+		}
+		alternatives = append(alternatives, items)
+	}
+	rhs := NewRHS()
+	rhs.tmpl = rule.Event.EventType
+	rhs.Extra["name"] = rule.Name
+	rhs.Extra["priority"] = rule.Priority
+	rhs.Extra["customProperty"] = rule.Event.CustomProperty
+
+	if len(all) == 0 && len(alternatives) == 0 {
+		return nil, fmt.Errorf("rule `%s` has no conditions", rule.Name)
+	}
+	if len(alternatives) == 0 {
+		return []Production{NewProduction(NewLHS(all...), rhs)}, nil
+	}
+	if len(all) > 0 {
+		var anyOf []interface{}
+		for _, items := range alternatives {
+			anyOf = append(anyOf, NewNccRule(items...))
+		}
+		items := append(all, NewNccRule(anyOf...))
+		return []Production{NewProduction(NewLHS(items...), rhs)}, nil
+	}
+	var ret []Production
+	for i, items := range alternatives {
+		items = append([]interface{}{}, items...)
+		for _, earlier := range alternatives[:i] {
+			items = append(items, NewNccRule(earlier...))
+		}
+		ret = append(ret, NewProduction(NewLHS(items...), rhs))
+	}
+	return ret, nil
+}
+
+// ruleCondition compiles the i-th condition of a rule. String and bool values
+// are matched as constants, numbers with a filter on the bound value.
+func ruleCondition(cond rules.Condition, i int) ([]interface{}, error) {
+	v := fmt.Sprintf("$v%d", i)
+	var number float64
+	switch value := cond.Value.(type) {
+	case string, bool:
+		s := fmt.Sprint(value)
+		switch cond.Operator {
+		case "equal":
+			return []interface{}{NewHas("$class", "$id", cond.Fact, s)}, nil
+		case "notEqual":
+			return []interface{}{
+				NewHas("$class", "$id", cond.Fact, v),
+				Filter{tmpl: v + " != " + strconv.Quote(s)},
+			}, nil
+		}
+		return nil, fmt.Errorf("operator `%s` not supported for %T", cond.Operator, cond.Value)
+	case float64:
+		number = value
+	case int:
+		number = float64(value)
+	default:
+		return nil, fmt.Errorf("value of fact `%s` not supported: %v", cond.Fact, cond.Value)
+	}
+	op, ok := ruleOperators[cond.Operator]
+	if !ok {
+		return nil, fmt.Errorf("operator `%s` not supported", cond.Operator)
+	}
+	return []interface{}{
+		NewHas("$class", "$id", cond.Fact, v),
+		Filter{tmpl: v + " " + op + " " + strconv.FormatFloat(number, 'f', -1, 64)},
+	}, nil
+}
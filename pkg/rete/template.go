@@ -0,0 +1,133 @@
+package rete
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Output is the rendered template of a firing.
+type Output struct {
+	// Production is named as in FiringError.
+	Production string
+	Token      *Token
+	Text       string
+}
+
+// Sink receives the output of templates.
+type Sink func(ctx context.Context, out Output) error
+
+// SetSink sets where rendered templates go.
+func (n *Network) SetSink(sink Sink) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.sink = sink
+}
+
+// SetTemplate parses a text/template that renders the output of the
+// production on firing. Its data are the bindings of the token, over the
+// entries of Extra, so {{.x}} is the value of $x. Adding the production fails
+// if the template reads a field that is neither.
+func (rhs *RHS) SetTemplate(text string) error {
+	t, err := template.New("rhs").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return err
+	}
+	rhs.template = t
+	rhs.templateText = text
+	return nil
+}
+
+// checkTemplate checks that every field the template of rhs reads is bound
+// by lhs or is a key of Extra. The fields in the body of a range or with are
+// of another value, and are not checked.
+func (rhs *RHS) checkTemplate(lhs LHS) error {
+	if rhs.template == nil {
+		return nil
+	}
+	bound := make(map[string]bool)
+	if err := validateItems(lhs.items, bound, nil); err != nil {
+		return err
+	}
+	fields := make(map[string]bool)
+	templateFields(rhs.template.Tree.Root, fields)
+	for name := range fields {
+		if _, ok := rhs.Extra[name]; !ok && !bound[name] {
+			return fmt.Errorf("template field `.%s` unbound", name)
+		}
+	}
+	return nil
+}
+
+// templateFields adds the names of the fields of the data that node reads.
+func templateFields(node parse.Node, fields map[string]bool) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, child := range node.Nodes {
+			templateFields(child, fields)
+		}
+	case *parse.ActionNode:
+		templateFields(node.Pipe, fields)
+	case *parse.PipeNode:
+		if node == nil {
+			return
+		}
+		for _, cmd := range node.Cmds {
+			templateFields(cmd, fields)
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			templateFields(arg, fields)
+		}
+	case *parse.ChainNode:
+		templateFields(node.Node, fields)
+	case *parse.FieldNode:
+		fields[node.Ident[0]] = true
+	case *parse.IfNode:
+		templateFields(node.Pipe, fields)
+		templateFields(node.List, fields)
+		templateFields(node.ElseList, fields)
+	case *parse.RangeNode:
+		templateFields(node.Pipe, fields)
+		templateFields(node.ElseList, fields)
+	case *parse.WithNode:
+		templateFields(node.Pipe, fields)
+		templateFields(node.ElseList, fields)
+	case *parse.TemplateNode:
+		templateFields(node.Pipe, fields)
+	}
+}
+
+// declarative tells whether the rhs does anything without a handler.
+func (rhs *RHS) declarative() bool {
+	return len(rhs.actions) > 0 || rhs.template != nil
+}
+
+// render executes the template of pNode for token and sends the output to
+// the sink.
+func (n *Network) render(ctx context.Context, pNode *BetaMemory, token *Token) error {
+	n.lock.RLock()
+	sink := n.sink
+	n.lock.RUnlock()
+	if sink == nil {
+		return errors.New("template output without a sink")
+	}
+	data := make(map[string]interface{})
+	for k, v := range pNode.RHS.Extra {
+		data[k] = v
+	}
+	for k, v := range token.AllBinding() {
+		data[k] = v
+	}
+	var b strings.Builder
+	if err := pNode.RHS.template.Execute(&b, data); err != nil {
+		return err
+	}
+	return sink(ctx, Output{Production: n.productionName(pNode), Token: token, Text: b.String()})
+}
@@ -16,7 +16,11 @@ type Token struct {
 	joinResults *list.List // used in negative nodes
 	nccResults  *list.List
 	owner       *Token
+	accumulator Accumulator // used in accumulate nodes
 	binding     Env
+	deleted     bool
+	// onDelete is set on tokens that logically support WMEs
+	onDelete func(*Token)
 }
 
 func (tok *Token) get_wmes() []*WME {
@@ -50,20 +54,61 @@ func makeToken(node IReteNode, parent *Token, w *WME, b Env) *Token {
 	return tok
 }
 
-func (tok *Token) deleteTokenAndDescendents() {
+func (tok *Token) deleteDescendents() {
 	for tok.children != nil && tok.children.Len() > 0 {
 		e := tok.children.Front()
 		child := e.Value.(*Token)
 		child.deleteTokenAndDescendents()
 		tok.children.Remove(e)
 	}
+}
+
+func (tok *Token) deleteTokenAndDescendents() {
+	tok.deleted = true
+	if tok.onDelete != nil {
+		tok.onDelete(tok)
+	}
+	tok.deleteDescendents()
 	removeByValue(tok.node.GetItems(), tok)
+	if pNode, ok := tok.node.(*BetaMemory); ok {
+		for _, l := range pNode.listeners.get() {
+			l.ActivationCancelled(pNode, tok)
+		}
+	}
 	if tok.wme != nil {
 		removeByValue(tok.wme.tokens, tok)
 	}
 	if tok.parent != nil {
 		removeByValue(tok.parent.children, tok)
 	}
+	switch tok.node.GetNodeType() {
+	case NegativeNodeTy, ExistsNodeTy, AccumulateNodeTy:
+		for e := tok.joinResults.Front(); e != nil; e = e.Next() {
+			jr := e.Value.(*NegativeJoinResult)
+			removeByValue(jr.wme.negativeJoinResults, jr)
+		}
+	case NccNodeTy:
+		for e := tok.nccResults.Front(); e != nil; e = e.Next() {
+			result := e.Value.(*Token)
+			if result.wme != nil {
+				removeByValue(result.wme.tokens, result)
+			}
+			if result.parent != nil {
+				removeByValue(result.parent.children, result)
+			}
+		}
+	case NccPartnerNodeTy:
+		if tok.owner == nil {
+			removeByValue(tok.node.(*NccPartnerNode).newResultBuffer, tok)
+			break
+		}
+		removeByValue(tok.owner.nccResults, tok)
+		if tok.owner.nccResults.Len() == 0 {
+			for e := tok.owner.node.GetChildren().Front(); e != nil; e = e.Next() {
+				e.Value.(IReteNode).LeftActivation(tok.owner, nil, nil)
+			}
+		}
+	}
 }
 
 func (tok *Token) String() string {
@@ -0,0 +1,111 @@
+package rete
+
+import (
+	"errors"
+)
+
+// truthMaintenance tracks the WMEs asserted logically and the tokens that
+// justify them. A WME whose last supporting token is deleted is queued in
+// pending, and retracted by settle once the change that deleted the token is
+// done; its retraction may in turn delete tokens, so retraction cascades.
+type truthMaintenance struct {
+	supports  map[*WME]map[*Token]bool
+	justifies map[*Token][]*WME
+	pending   []*WME
+}
+
+func newTruthMaintenance() *truthMaintenance {
+	return &truthMaintenance{
+		supports:  make(map[*WME]map[*Token]bool),
+		justifies: make(map[*Token][]*WME),
+	}
+}
+
+// AssertLogical adds a WME with the fields of w for as long as t matches. A
+// WME asserted logically by several tokens stays until all of them are
+// gone. An equal WME that was not asserted logically is left alone, as
+// stated facts need no support, and a WME retracted by hand loses its
+// support. Handlers should retract with Network.RemoveWME: the package-level
+// RemoveWME is only settled once the handler returns, and leaves the
+// support of the WME it removes.
+func (n *Network) AssertLogical(t *Token, w *WME) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.assertLogical(t, w.fields)
+}
+
+func (n *Network) assertLogical(t *Token, fields [4]string) error {
+	if t.deleted {
+		return errors.New("token deleted, nothing to support")
+	}
+	defer n.settle()
+	var w *WME
+	for _, x := range n.workingMemory() {
+		if x.fields == fields {
+			w = x
+			break
+		}
+	}
+	if w != nil && n.tms.supports[w] == nil {
+		return nil
+	}
+	added := w == nil
+	if added {
+		w = NewWME(fields[0], fields[1], fields[2], fields[3])
+		n.tms.supports[w] = make(map[*Token]bool)
+	}
+	if !n.tms.supports[w][t] {
+		n.tms.supports[w][t] = true
+		n.tms.justifies[t] = append(n.tms.justifies[t], w)
+		t.onDelete = n.tms.unsupport
+	}
+	// supported before it is added, in case adding it deletes t
+	if added {
+		n.wmeAsserted(w)
+		n.alphaRoot.activation(w)
+	}
+	return nil
+}
+
+// forget drops the support of w, retracted by other means than losing it.
+func (tms *truthMaintenance) forget(w *WME) {
+	for t := range tms.supports[w] {
+		var ws []*WME
+		for _, x := range tms.justifies[t] {
+			if x != w {
+				ws = append(ws, x)
+			}
+		}
+		if len(ws) == 0 {
+			delete(tms.justifies, t)
+		} else {
+			tms.justifies[t] = ws
+		}
+	}
+	delete(tms.supports, w)
+}
+
+// unsupport drops the support of t.
+func (tms *truthMaintenance) unsupport(t *Token) {
+	for _, w := range tms.justifies[t] {
+		delete(tms.supports[w], t)
+		if len(tms.supports[w]) == 0 {
+			tms.pending = append(tms.pending, w)
+		}
+	}
+	delete(tms.justifies, t)
+}
+
+// settle retracts the WMEs that lost their support, and those that lose it
+// as a result. The network lock is held.
+func (n *Network) settle() {
+	for len(n.tms.pending) > 0 {
+		w := n.tms.pending[0]
+		n.tms.pending = n.tms.pending[1:]
+		if supporters, ok := n.tms.supports[w]; !ok || len(supporters) > 0 {
+			continue
+		}
+		delete(n.tms.supports, w)
+		n.retract(w)
+	}
+}
@@ -65,6 +65,26 @@ func FromJSON(s string) (r []Production, err error) {
 		if err != nil {
 			return r, err
 		}
+		if err = validateLHS(production.lhs, isFunction); err != nil {
+			return r, err
+		}
+		if production.rhs.actions, err = parseActions(rhsObj); err != nil {
+			return r, err
+		}
+		if text, ok := rhsObj["template"].(string); ok {
+			if err = production.rhs.SetTemplate(text); err != nil {
+				return r, err
+			}
+			if err = production.rhs.checkTemplate(production.lhs); err != nil {
+				return r, err
+			}
+		}
+		if production.rhs.wmes, err = parseWMEVars(lhs, production.lhs); err != nil {
+			return r, err
+		}
+		if err = validateActions(production.lhs, production.rhs); err != nil {
+			return r, err
+		}
 		r = append(r, production)
 	}
 	return r, err
@@ -78,7 +98,7 @@ func JSONParseLHS(lhs []interface{}) (r LHS, err error) {
 			return r, errors.New(message)
 		}
 		switch cond["tag"] {
-		case "has", "neg":
+		case "has", "neg", "exists":
 			class, ok0 := cond["classname"].(string)
 			id, ok1 := cond["identifier"].(string)
 			attr, ok2 := cond["attribute"].(string)
@@ -87,11 +107,43 @@ func JSONParseLHS(lhs []interface{}) (r LHS, err error) {
 				message := fmt.Sprintf("condition missing fields: %s", cond)
 				return r, errors.New(message)
 			}
-			if cond["tag"] == "has" {
+			switch cond["tag"] {
+			case "has":
 				r.items = append(r.items, NewHas(class, id, attr, value))
-			} else {
+			case "neg":
 				r.items = append(r.items, NewNeg(class, id, attr, value))
+			case "exists":
+				r.items = append(r.items, NewExists(class, id, attr, value))
+			}
+		case "accumulate":
+			class, ok0 := cond["classname"].(string)
+			id, ok1 := cond["identifier"].(string)
+			attr, ok2 := cond["attribute"].(string)
+			value, ok3 := cond["value"].(string)
+			function, ok4 := cond["function"].(string)
+			result, ok5 := cond["result"].(string)
+			if !ok0 || !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !isVar(result) {
+				message := fmt.Sprintf("accumulate missing fields: %s", cond)
+				return r, errors.New(message)
 			}
+			of, _ := cond["of"].(string)
+			reducer, err := GetReducer(function)
+			if err != nil {
+				return r, err
+			}
+			r.items = append(r.items, NewAccumulate(NewHas(class, id, attr, value), of, reducer, result))
+		case "collect":
+			class, ok0 := cond["classname"].(string)
+			id, ok1 := cond["identifier"].(string)
+			attr, ok2 := cond["attribute"].(string)
+			value, ok3 := cond["value"].(string)
+			result, ok4 := cond["result"].(string)
+			if !ok0 || !ok1 || !ok2 || !ok3 || !ok4 || !isVar(result) {
+				message := fmt.Sprintf("collect missing fields: %s", cond)
+				return r, errors.New(message)
+			}
+			of, _ := cond["of"].(string)
+			r.items = append(r.items, NewCollect(NewHas(class, id, attr, value), of, result))
 		case "filter":
 			tmpl, ok := cond["tmpl"].(string)
 			if !ok {
@@ -99,6 +151,14 @@ func JSONParseLHS(lhs []interface{}) (r LHS, err error) {
 				return r, errors.New(message)
 			}
 			r.items = append(r.items, Filter{tmpl: tmpl})
+		case "bind":
+			result, ok0 := cond["result"].(string)
+			tmpl, ok1 := cond["tmpl"].(string)
+			if !ok0 || !ok1 || !isVar(result) {
+				message := fmt.Sprintf("bind missing fields: %s", cond)
+				return r, errors.New(message)
+			}
+			r.items = append(r.items, NewBind(result, tmpl))
 		case "ncc":
 			ncc, ok := cond["items"].([]interface{})
 			if !ok {
@@ -111,6 +171,21 @@ func JSONParseLHS(lhs []interface{}) (r LHS, err error) {
 			}
 			_rule.negative = true
 			r.items = append(r.items, _rule)
+		case "forall":
+			items, ok := cond["items"].([]interface{})
+			if !ok {
+				message := fmt.Sprintf("lhs not List: %s", cond["items"])
+				return r, errors.New(message)
+			}
+			if len(items) < 2 {
+				message := fmt.Sprintf("forall needs a condition and a requirement: %s", cond)
+				return r, errors.New(message)
+			}
+			_rule, err := JSONParseLHS(items)
+			if err != nil {
+				return r, err
+			}
+			r.items = append(r.items, NewForall(_rule.items[0], _rule.items[1:]...))
 		default:
 			message := fmt.Sprintf("tag error: %s", cond["tag"])
 			return r, errors.New(message)
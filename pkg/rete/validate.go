@@ -0,0 +1,277 @@
+package rete
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strconv"
+)
+
+// validateLHS checks an LHS before any node is built. Every filter must
+// compile, use only variables bound by earlier conditions and functions
+// known tells of, and not apply an operator to operands that can never fit
+// it. FromJSON checks against the functions of the package, and a network
+// against its own as well. With a nil known, called functions are not
+// checked.
+func validateLHS(lhs LHS, known func(name string) bool) error {
+	if len(lhs.items) == 0 {
+		return errors.New("production has no conditions")
+	}
+	if has, ok := lhs.items[0].(Has); !ok || has.negative {
+		return errors.New("first condition must be a positive has")
+	}
+	return validateItems(lhs.items, make(map[string]bool), known)
+}
+
+// validateItems checks items in order. Positive conditions and binds add the
+// names of their variables, without the `$`, to bound. Variables of negated
+// and existential conditions and of accumulated patterns stay local.
+func validateItems(items []interface{}, bound map[string]bool, known func(name string) bool) error {
+	for _, item := range items {
+		switch item := item.(type) {
+		case Has:
+			if !item.negative {
+				bindFields(item, bound)
+			}
+		case Exists:
+		case Accumulate:
+			if err := validateAccumulated(item.Has, item.of, item.result); err != nil {
+				return err
+			}
+			bound[varKey(item.result)] = true
+		case Collect:
+			if err := validateAccumulated(item.Has, item.of, item.result); err != nil {
+				return err
+			}
+			bound[varKey(item.result)] = true
+		case Filter:
+			if err := validateFilter(item.tmpl, bound, known); err != nil {
+				return err
+			}
+		case Bind:
+			if !isVar(item.variable) {
+				return fmt.Errorf("bind `%s` not a variable", item.variable)
+			}
+			if bound[varKey(item.variable)] {
+				return fmt.Errorf("bind `%s` already bound", item.variable)
+			}
+			if _, err := validateExpr(item.tmpl, bound, known); err != nil {
+				return err
+			}
+			bound[varKey(item.variable)] = true
+		case LHS:
+			if err := validateItems(item.items, copyBound(bound), known); err != nil {
+				return err
+			}
+		case Forall:
+			inner := append([]interface{}{item.cond}, item.requirements...)
+			if err := validateItems(inner, copyBound(bound), known); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("condition %T not supported", item)
+		}
+	}
+	return nil
+}
+
+func bindFields(c Has, bound map[string]bool) {
+	for _, field := range c.fields {
+		if isVar(field) {
+			bound[varKey(field)] = true
+		}
+	}
+}
+
+func copyBound(bound map[string]bool) map[string]bool {
+	ret := make(map[string]bool, len(bound))
+	for k := range bound {
+		ret[k] = true
+	}
+	return ret
+}
+
+func validateAccumulated(pattern Has, of string, result string) error {
+	if !isVar(result) {
+		return fmt.Errorf("accumulate result `%s` not a variable", result)
+	}
+	if of != "" && pattern.contain(of) == -1 {
+		return fmt.Errorf("accumulate of `%s` not in pattern %s", of, pattern.fields)
+	}
+	return nil
+}
+
+func validateFilter(tmpl string, bound map[string]bool, known func(name string) bool) error {
+	ty, err := validateExpr(tmpl, bound, known)
+	if err != nil {
+		return err
+	}
+	if ty != anyType && ty != boolType {
+		return fmt.Errorf("expression `%s`: %s is not a condition", tmpl, ty)
+	}
+	return nil
+}
+
+func validateExpr(tmpl string, bound map[string]bool, known func(name string) bool) (staticType, error) {
+	e, err := Compile(tmpl)
+	if err != nil {
+		return anyType, fmt.Errorf("expression `%s`: %w", tmpl, err)
+	}
+	ty, err := checkExpr(e.ast, bound, known)
+	if err != nil {
+		return ty, fmt.Errorf("expression `%s`: %w", tmpl, err)
+	}
+	return ty, nil
+}
+
+// staticType is what can be told about a value before evaluation. Bindings
+// and string literals that parse as a number, a bool, a duration or a time
+// are anyType, since the evaluator converts them as needed.
+type staticType int
+
+const (
+	anyType staticType = iota
+	numberType
+	stringType
+	boolType
+)
+
+func (ty staticType) String() string {
+	return [...]string{"value", "number", "string", "bool"}[ty]
+}
+
+func checkExpr(exp ast.Expr, bound map[string]bool, known func(name string) bool) (staticType, error) {
+	switch exp := exp.(type) {
+	case *ast.BasicLit:
+		if exp.Kind != token.STRING {
+			return numberType, nil
+		}
+		s, _ := strconv.Unquote(exp.Value)
+		if _, ok := asFloat(s); ok {
+			return anyType, nil
+		}
+		if _, err := strconv.ParseBool(s); err == nil {
+			return anyType, nil
+		}
+		if _, ok := asDuration(s); ok {
+			return anyType, nil
+		}
+		if _, ok := asTime(s); ok {
+			return anyType, nil
+		}
+		return stringType, nil
+	case *ast.ParenExpr:
+		return checkExpr(exp.X, bound, known)
+	case *ast.Ident:
+		switch {
+		case bound[exp.Name]:
+			return anyType, nil
+		case exp.Name == "true" || exp.Name == "false":
+			return boolType, nil
+		case isFunction(exp.Name) || known != nil && known(exp.Name):
+			return anyType, nil
+		}
+		return anyType, fmt.Errorf("variable `$%s` unbound", exp.Name)
+	case *ast.UnaryExpr:
+		x, err := checkExpr(exp.X, bound, known)
+		if err != nil {
+			return x, err
+		}
+		if exp.Op == token.NOT {
+			return boolType, checkOperand(exp.Op, x, boolType)
+		}
+		return numberType, checkOperand(exp.Op, x, numberType)
+	case *ast.BinaryExpr:
+		x, err := checkExpr(exp.X, bound, known)
+		if err != nil {
+			return x, err
+		}
+		y, err := checkExpr(exp.Y, bound, known)
+		if err != nil {
+			return y, err
+		}
+		switch exp.Op {
+		case token.LAND, token.LOR:
+			if err := checkOperand(exp.Op, x, boolType); err != nil {
+				return boolType, err
+			}
+			return boolType, checkOperand(exp.Op, y, boolType)
+		case token.EQL, token.NEQ, token.LSS, token.GTR, token.LEQ, token.GEQ:
+			if x != anyType && y != anyType && x != y {
+				return boolType, fmt.Errorf("cannot compare %s and %s", x, y)
+			}
+			if exp.Op != token.EQL && exp.Op != token.NEQ && (x == boolType || y == boolType) {
+				return boolType, fmt.Errorf("cannot order %s", boolType)
+			}
+			return boolType, nil
+		}
+		if err := checkOperand(exp.Op, x, numberType); err != nil {
+			return numberType, err
+		}
+		if err := checkOperand(exp.Op, y, numberType); err != nil {
+			return numberType, err
+		}
+		// Times and durations add and subtract among themselves, and
+		// durations scale by numbers.
+		switch exp.Op {
+		case token.ADD, token.SUB:
+			if x == anyType && y == anyType {
+				return anyType, nil
+			}
+		case token.MUL, token.QUO:
+			if x == anyType || y == anyType {
+				return anyType, nil
+			}
+		}
+		return numberType, nil
+	case *ast.SelectorExpr:
+		_, err := checkExpr(exp.X, bound, known)
+		return anyType, err
+	case *ast.IndexExpr:
+		if _, err := checkExpr(exp.X, bound, known); err != nil {
+			return anyType, err
+		}
+		_, err := checkExpr(exp.Index, bound, known)
+		return anyType, err
+	case *ast.CompositeLit:
+		for _, elt := range exp.Elts {
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				if _, err := checkExpr(kv.Key, bound, known); err != nil {
+					return anyType, err
+				}
+				elt = kv.Value
+			}
+			if _, err := checkExpr(elt, bound, known); err != nil {
+				return anyType, err
+			}
+		}
+		return anyType, nil
+	case *ast.CallExpr:
+		if fun, ok := exp.Fun.(*ast.Ident); ok && (fun.Name == listFunction || fun.Name == inFunction) {
+			for _, arg := range exp.Args {
+				if _, err := checkExpr(arg, bound, known); err != nil {
+					return anyType, err
+				}
+			}
+			return anyType, nil
+		}
+		if fun, ok := exp.Fun.(*ast.Ident); ok && known != nil && !bound[fun.Name] && !known(fun.Name) {
+			return anyType, fmt.Errorf("function `%s` undefined", fun.Name)
+		}
+		for _, arg := range exp.Args {
+			if _, err := checkExpr(arg, bound, known); err != nil {
+				return anyType, err
+			}
+		}
+		return anyType, nil
+	}
+	return anyType, nil
+}
+
+func checkOperand(op token.Token, ty staticType, want staticType) error {
+	if ty != anyType && ty != want {
+		return fmt.Errorf("OP `%s` on %s", op, ty)
+	}
+	return nil
+}
@@ -6,12 +6,15 @@ import (
 )
 
 type WME struct {
-	fields              [4]string
-	alphaMems           *list.List
-	tokens              *list.List
+	fields    [4]string
+	alphaMems *list.List
+	tokens    *list.List
+	// join results of negative, exists and accumulate nodes this WME takes part in
 	negativeJoinResults *list.List
 }
 
+// RemoveWME removes w from the network it was added to. It tells no
+// listeners and leaves logical assertions alone; Network.RemoveWME does both.
 func RemoveWME(w *WME) {
 	for e := w.alphaMems.Front(); e != nil; e = e.Next() {
 		amem := e.Value.(*AlphaMemory)
@@ -26,11 +29,20 @@ func RemoveWME(w *WME) {
 	for e := w.negativeJoinResults.Front(); e != nil; e = e.Next() {
 		jr := e.Value.(*NegativeJoinResult)
 		removeByValue(jr.owner.joinResults, jr)
-		if jr.owner.joinResults.Len() == 0 {
-			for i := jr.owner.node.GetChildren().Front(); i != nil; i = i.Next() {
-				child := i.Value.(IReteNode)
-				child.LeftActivation(jr.owner, nil, nil)
-			}
+		if jr.owner.node.GetNodeType() == AccumulateNodeTy {
+			jr.owner.node.(*AccumulateNode).retract(jr.owner, w)
+			continue
+		}
+		if jr.owner.joinResults.Len() > 0 {
+			continue
+		}
+		if jr.owner.node.GetNodeType() == ExistsNodeTy {
+			jr.owner.deleteDescendents()
+			continue
+		}
+		for i := jr.owner.node.GetChildren().Front(); i != nil; i = i.Next() {
+			child := i.Value.(IReteNode)
+			child.LeftActivation(jr.owner, nil, nil)
 		}
 	}
 }
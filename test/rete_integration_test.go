@@ -26,14 +26,22 @@ func TestRuleEvaluation(t *testing.T) {
 
 	// Step 2: Construct the Rete network based on the rule
 	network := rete.NewNetwork()
-	network.LoadRule(rule) // Assuming LoadRule handles the construction
+	if err := network.LoadRuleFromObject(rule); err != nil {
+		t.Fatalf("Failed to load rule: %v", err)
+	}
 
 	// Step 3: Insert facts and run the evaluation
-	network.AddFact(rete.NewWME("age", 20)) // Example fact
-	triggeredEvents := network.Evaluate()   // Assuming Evaluate runs the network and returns triggered events
+	network.AddWME(rete.NewWME("User", "U1", "age", "20"))
+	var triggeredEvents []string
+	env := rete.Env{"UserIsAdult": func(n *rete.Network, tok *rete.Token) {
+		triggeredEvents = append(triggeredEvents, tok.GetRHSParam("name").(string))
+	}}
+	if err := network.ExecuteRules(env); err != nil {
+		t.Fatalf("Failed to execute rules: %v", err)
+	}
 
 	// Step 4: Verify the expected event is triggered
-	if len(triggeredEvents) != 1 || triggeredEvents[0].EventType != "UserIsAdult" {
+	if len(triggeredEvents) != 1 || triggeredEvents[0] != "AdultUser" {
 		t.Errorf("Expected UserIsAdult event to be triggered")
 	}
 }